@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cloudnautique/rbs-sandbox/rancher"
@@ -25,43 +27,308 @@ func main() {
 			Usage: "Path where Admin Keys will be stored",
 			Value: "./.keys",
 		},
+		cli.IntFlag{
+			Name:  "parallelism",
+			Usage: "How many independent steps, e.g. the registries of different projects, run at the same time",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "state-file",
+			Usage: "Keep the IDs of managed projects and accounts here, so renaming them in the config renames them on the server",
+		},
+		cli.StringFlag{
+			Name:  "only",
+			Usage: "Only configure these kinds, comma separated: auth, accounts, projects, members, volumes, registries, prepull, catalog, stacks, apikeys",
+		},
+		cli.StringFlag{
+			Name:  "project",
+			Usage: "Only configure these projects, comma separated",
+		},
+		cli.StringFlag{
+			Name:  "resource",
+			Usage: "Only configure these resources, comma separated kind:name, e.g. registry:test1.example.com, names may be globs",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: "How long to wait for another run against the same server to finish",
+			Value: 5 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:  "backup-dir",
+			Usage: "Back up the server here before every run, as a timestamped JSON file",
+		},
+		cli.BoolFlag{
+			Name:  "revert-on-failure",
+			Usage: "Roll a failed run back to the backup taken before it, needs --backup-dir",
+		},
+		cli.StringFlag{
+			Name:  "metrics-file",
+			Usage: "Write Prometheus metrics of the run here, for the node_exporter textfile collector",
+		},
 	}
 	app.Commands = []cli.Command{
+		{
+			Name:   "apply",
+			Usage:  "Configure the server, or the servers of an inventory, to match the config, the same as running without a command",
+			Action: appInit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "inventory",
+					Usage: "Inventory file listing servers with their url, key file and configs",
+				},
+				cli.StringFlag{
+					Name:  "servers",
+					Usage: "Only configure these servers of the inventory, comma separated, names may be globs",
+				},
+			},
+		},
 		{
 			Name:    "registration-command",
 			Aliases: []string{"rc"},
 			Usage:   "Get the registration command for nodes",
 			Action:  appEnvironmentRegistrationTokens,
 		},
+		{
+			Name:   "export-stacks",
+			Usage:  "Export the compose files of all stacks in the configured environments",
+			Action: appExportStacks,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "o,output-dir",
+					Usage: "Directory the stacks are written to as <environment>/<stack>/",
+					Value: "./stacks",
+				},
+				cli.BoolFlag{
+					Name:  "stacks-config",
+					Usage: "Also write a stacks.yml in the stacks: config format",
+				},
+			},
+		},
+		{
+			Name:   "snapshot",
+			Usage:  "Snapshot the volumes matching the given patterns in the configured environments",
+			Action: appSnapshotVolumes,
+		},
+		{
+			Name:   "serve",
+			Usage:  "Keep reconciling the server on an interval and whenever the config file changes",
+			Action: appServe,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "Time between full reconcile runs",
+					Value: 5 * time.Minute,
+				},
+				cli.BoolTFlag{
+					Name:  "events",
+					Usage: "Reconcile changes as soon as the server reports them, use --events=false to only reconcile on the interval",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "Address /healthz and /status are served on",
+					Value: ":8080",
+				},
+			},
+		},
+		{
+			Name:   "import",
+			Usage:  "Adopt the existing projects and accounts of the config into the state file",
+			Action: appImport,
+		},
+		{
+			Name:   "rollback",
+			Usage:  "Restore the server to a backup taken with --backup-dir",
+			Action: appRollback,
+		},
+		{
+			Name:   "force-unlock",
+			Usage:  "Remove the run lock of the server, when the run holding it died",
+			Action: appForceUnlock,
+		},
+		{
+			Name:   "audit",
+			Usage:  "Query the audit log",
+			Action: appAudit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show entries after this time, as RFC3339 or a duration ago (24h)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only show entries before this time, as RFC3339 or a duration ago (1h)",
+				},
+				cli.StringFlag{
+					Name:  "account",
+					Usage: "Only show entries by the account with this name",
+				},
+				cli.StringFlag{
+					Name:  "event-type",
+					Usage: "Only show entries of this event type",
+				},
+				cli.StringFlag{
+					Name:  "resource-type",
+					Usage: "Only show entries for this resource type",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Output format: table, json or csv",
+					Value: "table",
+				},
+				cli.BoolFlag{
+					Name:  "f,follow",
+					Usage: "Keep polling for new entries",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "Poll interval in follow mode",
+					Value: 5 * time.Second,
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
 }
 
 func appInit(c *cli.Context) {
-	RancherServer := rancher.NewRancherServer(c.String("config-file"), c.String("key-file"))
-	err := RancherServer.ConfigureAuthBackend()
-	if err != nil {
-		logrus.Fatalf("Failed to Configure auth: %s", err)
+	if inventory := c.String("inventory"); inventory != "" {
+		appApplyFleet(c, inventory)
+		return
 	}
 
-	err = RancherServer.ConfigureAccounts()
-	if err != nil {
-		logrus.Fatalf("Failed to Configure Accounts: %s", err)
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	if err := setupServer(c, RancherServer); err != nil {
+		logrus.Fatal(err)
+	}
+	if stateFile := c.GlobalString("state-file"); stateFile != "" {
+		if err := RancherServer.SetStateFile(stateFile); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	status := RancherServer.ApplyOnce()
+	writeMetricsFile(c)
+
+	if !status.Success {
+		logrus.Fatal(status.Error)
+	}
+}
+
+func appApplyFleet(c *cli.Context, inventory string) {
+	if c.GlobalIsSet("state-file") {
+		logrus.Fatal("--state-file can not be used with --inventory, set state_file per server")
 	}
 
-	err = RancherServer.ConfigureEnvironments()
+	fleet, err := rancher.LoadFleet(inventory)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	servers, err := fleet.Match(splitList(c.String("servers")))
 	if err != nil {
-		logrus.Fatalf("Failed to Configure Accounts: %s", err)
+		logrus.Fatal(err)
+	}
+
+	results := fleet.Apply(servers, func(r *rancher.RancherServer) error {
+		return setupServer(c, r)
+	})
+	writeMetricsFile(c)
+	rancher.WriteFleetSummary(os.Stdout, results)
+
+	for _, result := range results {
+		if !result.Status.Success {
+			logrus.Fatal("Failed to configure some servers")
+		}
+	}
+}
+
+// setupServer passes the global options of a run on to r.
+func setupServer(c *cli.Context, r *rancher.RancherServer) error {
+	r.SetParallelism(c.GlobalInt("parallelism"))
+	r.SetLockTimeout(c.GlobalDuration("lock-timeout"))
+	if c.GlobalBool("revert-on-failure") && c.GlobalString("backup-dir") == "" {
+		return fmt.Errorf("--revert-on-failure needs --backup-dir")
+	}
+	r.SetBackups(c.GlobalString("backup-dir"), c.GlobalBool("revert-on-failure"))
+	return r.SetFilter(getFilter(c.GlobalString("only"), c.GlobalString("project"), c.GlobalString("resource")))
+}
+
+func writeMetricsFile(c *cli.Context) {
+	if metricsFile := c.GlobalString("metrics-file"); metricsFile != "" {
+		if err := rancher.WriteMetricsFile(metricsFile); err != nil {
+			logrus.Errorf("Failed to write metrics: %s", err)
+		}
+	}
+}
+
+func appImport(c *cli.Context) {
+	stateFile := c.GlobalString("state-file")
+	if stateFile == "" {
+		logrus.Fatal("import needs --state-file")
+	}
+
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	if err := RancherServer.SetStateFile(stateFile); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := RancherServer.ImportState(); err != nil {
+		logrus.Fatalf("Failed to Import: %s", err)
 	}
-	err = RancherServer.ConfigureEnvironmentAccess()
+}
+
+func appServe(c *cli.Context) {
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	if err := setupServer(c, RancherServer); err != nil {
+		logrus.Fatal(err)
+	}
+	if stateFile := c.GlobalString("state-file"); stateFile != "" {
+		if err := RancherServer.SetStateFile(stateFile); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	err := RancherServer.Serve(c.GlobalString("config-file"), c.Duration("interval"), c.String("listen"), c.BoolT("events"))
 	if err != nil {
-		logrus.Fatalf("Failed to Configure Accounts: %s", err)
+		logrus.Fatalf("Failed to Serve: %s", err)
+	}
+}
+
+func appRollback(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		logrus.Fatalf("Need the backup to roll back to")
 	}
 
-	err = RancherServer.ConfigureRegistries()
+	backup, err := rancher.LoadBackup(c.Args()[0])
 	if err != nil {
-		logrus.Fatalf("Failed to Configure Registries: %s", err)
+		logrus.Fatal(err)
+	}
+
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	RancherServer.SetLockTimeout(c.GlobalDuration("lock-timeout"))
+	RancherServer.SetBackups(c.GlobalString("backup-dir"), false)
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	status := RancherServer.Rollback(backup)
+	writeMetricsFile(c)
+
+	if !status.Success {
+		logrus.Fatalf("Failed to Roll Back: %s", status.Error)
+	}
+}
+
+func appForceUnlock(c *cli.Context) {
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+
+	if err := RancherServer.ForceUnlock(); err != nil {
+		logrus.Fatalf("Failed to Unlock: %s", err)
 	}
 }
 
@@ -80,3 +347,91 @@ func appEnvironmentRegistrationTokens(c *cli.Context) {
 		fmt.Println(cmd)
 	}
 }
+
+func appExportStacks(c *cli.Context) {
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	err := RancherServer.ExportStacks(c.String("output-dir"), c.Bool("stacks-config"))
+	if err != nil {
+		logrus.Fatalf("Failed to Export Stacks: %s", err)
+	}
+}
+
+func appSnapshotVolumes(c *cli.Context) {
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+	RancherServer.CloseOnExit()
+	defer RancherServer.Close()
+
+	if len(c.Args()) == 0 {
+		logrus.Fatalf("Need at least one volume name pattern")
+	}
+
+	err := RancherServer.SnapshotVolumes(c.Args())
+	if err != nil {
+		logrus.Fatalf("Failed to Snapshot Volumes: %s", err)
+	}
+}
+
+func appAudit(c *cli.Context) {
+	RancherServer := rancher.NewRancherServer(c.GlobalString("config-file"), c.GlobalString("key-file"))
+
+	since, err := parseTime(c.String("since"))
+	if err != nil {
+		logrus.Fatalf("Invalid --since: %s", err)
+	}
+	until, err := parseTime(c.String("until"))
+	if err != nil {
+		logrus.Fatalf("Invalid --until: %s", err)
+	}
+
+	query := &rancher.AuditQuery{
+		Since:        since,
+		Until:        until,
+		Account:      c.String("account"),
+		EventType:    c.String("event-type"),
+		ResourceType: c.String("resource-type"),
+	}
+
+	err = RancherServer.QueryAuditLog(query, c.String("format"), os.Stdout, c.Bool("follow"), c.Duration("interval"))
+	if err != nil {
+		logrus.Fatalf("Failed to Query Audit Log: %s", err)
+	}
+}
+
+// parseTime parses an RFC3339 time, or a duration that is subtracted from
+// the current time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither an RFC3339 time nor a duration", value)
+	}
+	return time.Now().Add(-duration), nil
+}
+
+func getFilter(only string, projects string, resources string) *rancher.Filter {
+	return &rancher.Filter{
+		Kinds:     splitList(only),
+		Projects:  splitList(projects),
+		Resources: splitList(resources),
+	}
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
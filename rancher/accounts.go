@@ -0,0 +1,310 @@
+package rancher
+
+import (
+	"fmt"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func (r *RancherServer) ConfigureAccounts() error {
+	accounts, err := r.inventory.Accounts()
+	if err != nil {
+		return err
+	}
+
+	for key, acct := range r.config.Accounts {
+		if !r.selected("account", key) {
+			continue
+		}
+
+		existing, password, err := r.findAccount(accounts, key, acct)
+		if err != nil {
+			return err
+		}
+
+		if acct.State == "Purged" {
+			if existing != nil {
+				r.log.Infof("Purging Acct: %s", key)
+				r.checkManaged("account", key, existing.Description, existing.Data)
+				if err := r.purgeAccount(existing); err != nil {
+					return err
+				}
+				r.recordChange("", "account", "delete", key)
+			}
+			if err := r.state.remove("account", key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if existing == nil {
+			name := acct.Name
+			if name == "" {
+				name = acct.Username
+			}
+
+			r.log.Infof("Adding Acct: %s", key)
+			owner := r.newOwnership()
+			existing, err = r.client.Account.Create(&client.Account{
+				ExternalId:     acct.ExternalId,
+				ExternalIdType: acct.ExternalIdType,
+				Kind:           acct.Kind,
+				Name:           name,
+				Description:    owner.description(acct.Description),
+				Data:           owner.data(nil),
+			})
+			if err != nil {
+				return err
+			}
+			if err := waitForAccount(r.client, existing); err != nil {
+				return err
+			}
+			r.recordChange("", "account", "create", key)
+		} else if updates := accountUpdates(existing, acct); len(updates) > 0 {
+			r.log.Infof("Updating Acct: %s", key)
+			r.checkManaged("account", key, existing.Description, existing.Data)
+			existing, err = r.client.Account.Update(existing, updates)
+			if err != nil {
+				return err
+			}
+			r.recordChange("", "account", "update", key)
+		}
+
+		if err := r.state.set("account", key, existing.Id); err != nil {
+			return err
+		}
+
+		if acct.isLocal() {
+			if err := r.configureAccountPassword(key, existing, password, acct); err != nil {
+				return err
+			}
+		}
+
+		if err := r.setAccountState(key, existing, acct.State); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findAccount looks up the server side account for the one under key in
+// the config. Accounts in the state file are matched on their ID, other LDAP
+// accounts on ExternalId and other local accounts through the password
+// credential holding their username.
+func (r *RancherServer) findAccount(collection *client.AccountCollection, key string, acct *Account) (*client.Account, *client.Password, error) {
+	var password *client.Password
+	if acct.isLocal() {
+		var err error
+		if password, err = getAccountPassword(r.client, acct.Username); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if id := r.state.get("account", key); id != "" {
+		for i, existing := range collection.Data {
+			if existing.Id == id {
+				return &collection.Data[i], password, nil
+			}
+		}
+		r.log.Warnf("Account %s in the state file is gone: %s", key, id)
+		if err := r.state.remove("account", key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !acct.isLocal() {
+		return getExistingAccount(collection, &acct.Account), nil, nil
+	}
+
+	if password == nil {
+		return nil, nil, nil
+	}
+
+	for i, existing := range collection.Data {
+		if existing.Id == password.AccountId {
+			return &collection.Data[i], password, nil
+		}
+	}
+	return nil, password, nil
+}
+
+// accountUpdates returns the changes needed to bring an existing account in
+// line with the config.
+func accountUpdates(existing *client.Account, acct *Account) map[string]interface{} {
+	updates := map[string]interface{}{}
+	if acct.Kind != "" && existing.Kind != acct.Kind {
+		updates["kind"] = acct.Kind
+	}
+	if acct.Name != "" && existing.Name != acct.Name {
+		updates["name"] = acct.Name
+	}
+	return updates
+}
+
+func (r *RancherServer) configureAccountPassword(key string, account *client.Account, password *client.Password, acct *Account) error {
+	if password != nil && !acct.RotatePassword {
+		return nil
+	}
+
+	secret, err := resolveSecret(acct.Password)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return fmt.Errorf("No password configured for local Acct: %s", key)
+	}
+
+	if password == nil {
+		r.log.Infof("Adding password for Acct: %s", key)
+		data, err := withSecretHash(nil, r.secretHashKey(), secret)
+		if err != nil {
+			return err
+		}
+		_, err = r.client.Password.Create(&client.Password{
+			AccountId:   account.Id,
+			Name:        acct.Username,
+			PublicValue: acct.Username,
+			SecretValue: secret,
+			Data:        data,
+		})
+		if err == nil {
+			r.recordChange("", "password", "create", key)
+		}
+		return err
+	}
+
+	// Like registry credentials, passwords are compared to the hash kept in
+	// their data, the server does not return them.
+	if secretMatches(password.Data, r.secretHashKey(), secret) {
+		return nil
+	}
+	data, err := withSecretHash(password.Data, r.secretHashKey(), secret)
+	if err != nil {
+		return err
+	}
+
+	r.log.Infof("Rotating password for Acct: %s", key)
+	if _, err := r.client.Password.ActionChangesecret(password, &client.ChangeSecretInput{
+		NewSecret: secret,
+	}); err != nil {
+		return err
+	}
+	if _, err := r.client.Password.Update(password, map[string]interface{}{
+		"data": data,
+	}); err != nil {
+		return err
+	}
+	r.recordChange("", "password", "update", key)
+	return nil
+}
+
+func getAccountPassword(rClient *client.RancherClient, username string) (*client.Password, error) {
+	passwords, err := rClient.Password.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"publicValue": username,
+		},
+	})
+	if err == nil {
+		err = followPages(rClient, passwords)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, password := range passwords.Data {
+		if password.PublicValue == username && password.State != "removed" && password.State != "purged" {
+			return &passwords.Data[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *RancherServer) setAccountState(key string, account *client.Account, state string) error {
+	var err error
+	switch {
+	case state == "inactive" && account.State == "active":
+		if err = r.checkNotOwnAccount(account); err != nil {
+			return err
+		}
+		r.log.Infof("Deactivating Acct: %s", key)
+		_, err = r.client.Account.ActionDeactivate(account)
+	case state == "active" && account.State == "inactive":
+		r.log.Infof("Activating Acct: %s", key)
+		_, err = r.client.Account.ActionActivate(account)
+	default:
+		return nil
+	}
+	if err == nil {
+		r.recordChange("", "account", "update", key)
+	}
+	return err
+}
+
+func (r *RancherServer) purgeAccount(account *client.Account) error {
+	if err := r.checkNotOwnAccount(account); err != nil {
+		return err
+	}
+
+	var err error
+	if account.State == "active" {
+		if account, err = r.client.Account.ActionDeactivate(account); err != nil {
+			return err
+		}
+		if err = waitForAccount(r.client, account); err != nil {
+			return err
+		}
+	}
+
+	if account.State == "inactive" {
+		if account, err = r.client.Account.ActionRemove(account); err != nil {
+			return err
+		}
+		if err = waitForAccount(r.client, account); err != nil {
+			return err
+		}
+	}
+
+	if account.State == "removed" {
+		_, err = r.client.Account.ActionPurge(account)
+	}
+
+	return err
+}
+
+// checkNotOwnAccount refuses changes that would lock rbs out of the server by
+// disabling the account owning the API key it is using.
+func (r *RancherServer) checkNotOwnAccount(account *client.Account) error {
+	keys, err := r.client.ApiKey.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"publicValue": r.client.Opts.AccessKey,
+		},
+	})
+	if err == nil {
+		err = followPages(r.client, keys)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys.Data {
+		if key.AccountId == account.Id {
+			return fmt.Errorf("Refusing to disable account %s, it owns the API key in use: %s", account.Id, key.PublicValue)
+		}
+	}
+	return nil
+}
+
+func waitForAccount(rClient *client.RancherClient, account *client.Account) error {
+	return WaitFor(rClient, &account.Resource, account, func() string {
+		return account.Transitioning
+	})
+}
+
+func getExistingAccount(collection *client.AccountCollection, account *client.Account) *client.Account {
+	for i, acct := range collection.Data {
+		if account.ExternalId == acct.ExternalId {
+			return &collection.Data[i]
+		}
+	}
+	return nil
+}
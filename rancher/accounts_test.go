@@ -0,0 +1,157 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func ldapAccount(name string) *Account {
+	return &Account{
+		Account: client.Account{
+			ExternalId:     "cn=" + name + ",dc=example,dc=com",
+			ExternalIdType: "ldap_user",
+			Kind:           "user",
+			Name:           name,
+		},
+	}
+}
+
+func (s *testServer) accounts() []client.Account {
+	accounts := []client.Account{}
+	s.fake.List("account", &accounts)
+	return accounts
+}
+
+func TestApplyCreatesAccounts(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Accounts: map[string]*Account{
+			"alice": ldapAccount("alice"),
+		},
+	})
+	defer s.Close()
+
+	s.apply(t)
+
+	accounts := s.accounts()
+	if len(accounts) != 1 || accounts[0].ExternalId != "cn=alice,dc=example,dc=com" || accounts[0].Kind != "user" {
+		t.Fatalf("Expected the account of alice, got %#v", accounts)
+	}
+	if !isManaged(accounts[0].Description, accounts[0].Data) {
+		t.Errorf("Account not managed: %#v", accounts[0])
+	}
+
+	s.config.Accounts["alice"].Kind = "admin"
+	s.apply(t)
+	if accounts := s.accounts(); len(accounts) != 1 || accounts[0].Kind != "admin" {
+		t.Fatalf("Expected alice to become admin, got %#v", accounts)
+	}
+}
+
+func TestApplyDeactivatesAccounts(t *testing.T) {
+	alice := ldapAccount("alice")
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Accounts: map[string]*Account{"alice": alice},
+	})
+	defer s.Close()
+	s.fake.Add("account", &alice.Account)
+
+	alice.State = "inactive"
+
+	s.apply(t)
+	if accounts := s.accounts(); accounts[0].State != "inactive" {
+		t.Fatalf("Expected alice inactive, got %s", accounts[0].State)
+	}
+
+	alice.State = "active"
+	s.apply(t)
+	if accounts := s.accounts(); accounts[0].State != "active" {
+		t.Fatalf("Expected alice active, got %s", accounts[0].State)
+	}
+}
+
+func TestApplyPurgesAccounts(t *testing.T) {
+	alice := ldapAccount("alice")
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Accounts: map[string]*Account{"alice": alice},
+	})
+	defer s.Close()
+	s.fake.Add("account", &alice.Account)
+
+	alice.State = "Purged"
+
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "delete" {
+		t.Fatalf("Expected a delete, got %v", status.Changes)
+	}
+	if accounts := s.accounts(); len(accounts) != 0 {
+		t.Fatalf("Account not purged: %#v", accounts)
+	}
+}
+
+func TestApplyKeepsOwnAccount(t *testing.T) {
+	admin := ldapAccount("admin")
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Accounts: map[string]*Account{"admin": admin},
+	})
+	defer s.Close()
+
+	own := admin.Account
+	own.Id = "1a1"
+	s.fake.Add("account", &own)
+
+	admin.State = "Purged"
+
+	status := s.ApplyOnce()
+	if status.Success || !strings.Contains(status.Error, "Refusing to disable account 1a1") {
+		t.Fatalf("Expected the run to refuse, got %#v", status)
+	}
+	if accounts := s.accounts(); len(accounts) != 1 || accounts[0].State != "active" {
+		t.Fatalf("Own account changed: %#v", accounts)
+	}
+}
+
+func TestApplyCreatesLocalAccounts(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Accounts: map[string]*Account{
+			"ci": {Username: "ci", Password: "s3cret"},
+		},
+	})
+	defer s.Close()
+
+	s.apply(t)
+
+	passwords := []client.Password{}
+	s.fake.List("password", &passwords)
+	accounts := s.accounts()
+	if len(accounts) != 1 || accounts[0].Name != "ci" {
+		t.Fatalf("Expected the account ci, got %#v", accounts)
+	}
+	if len(passwords) != 1 || passwords[0].PublicValue != "ci" || passwords[0].SecretValue != "s3cret" || passwords[0].AccountId != accounts[0].Id {
+		t.Fatalf("Expected the password of ci, got %#v", passwords)
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+
+	s.config.Accounts["ci"].Password = "n3w"
+	s.config.Accounts["ci"].RotatePassword = true
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected the password rotated, got %v", status.Changes)
+	}
+	s.fake.List("password", &passwords)
+	if passwords[0].SecretValue != "n3w" {
+		t.Fatalf("Password not rotated: %#v", passwords[0])
+	}
+
+	before := len(s.fake.Requests())
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Unchanged password rotated again: %v", status.Changes)
+	}
+	for _, request := range s.fake.Requests()[before:] {
+		if strings.Contains(request, "changesecret") {
+			t.Fatalf("Unexpected request: %s", request)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package rancher
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/rancher/go-rancher/client"
+)
+
+type storedApiKey struct {
+	Id        string `yaml:"id"`
+	AccountId string `yaml:"account_id"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// ConfigureApiKeys creates the named API keys declared in the config and
+// removes the ones rbs created earlier that are no longer declared. Secrets
+// are only returned by Rancher on creation, so they are kept in the keystore.
+func (r *RancherServer) ConfigureApiKeys() error {
+	if r.config.ApiKeys == nil {
+		return nil
+	}
+
+	keyStore := r.config.ApiKeys.KeyStore
+	if keyStore == "" {
+		return fmt.Errorf("apikeys.keystore must be set to manage API keys")
+	}
+
+	stored, err := readApiKeyStore(keyStore)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range r.config.ApiKeys.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !r.selected("apikey", name) {
+			continue
+		}
+
+		keyConfig := r.config.ApiKeys.Keys[name]
+		accountId, err := r.getApiKeyAccountId(name, keyConfig)
+		if err != nil {
+			return err
+		}
+
+		existing, err := getApiKeyByName(r.client, accountId, name)
+		if err != nil {
+			return err
+		}
+
+		if existing != nil {
+			if _, ok := stored[name]; ok {
+				continue
+			}
+			r.log.Warnf("Secret for API key %s is not in the keystore, recreating it", name)
+			r.checkManaged("API key", name, existing.Description, existing.Data)
+			if err := r.client.ApiKey.Delete(existing); err != nil {
+				return err
+			}
+		}
+
+		r.log.Infof("Creating API key: %s", name)
+		owner := r.newOwnership()
+		apiKey, err := r.client.ApiKey.Create(&client.ApiKey{
+			AccountId:   accountId,
+			Name:        name,
+			Description: owner.description(keyConfig.Description),
+			Data:        owner.data(nil),
+		})
+		if err != nil {
+			return err
+		}
+
+		stored[name] = &storedApiKey{
+			Id:        apiKey.Id,
+			AccountId: accountId,
+			AccessKey: apiKey.PublicValue,
+			SecretKey: apiKey.SecretValue,
+		}
+		r.recordChange("", "apikey", "create", name)
+		if err := writeApiKeyStore(keyStore, stored); err != nil {
+			return err
+		}
+	}
+
+	for name, key := range stored {
+		if _, ok := r.config.ApiKeys.Keys[name]; ok || !r.selected("apikey", name) {
+			continue
+		}
+
+		existing, err := getApiKeyByName(r.client, key.AccountId, name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			r.log.Infof("Removing API key: %s", name)
+			r.checkManaged("API key", name, existing.Description, existing.Data)
+			if err := r.client.ApiKey.Delete(existing); err != nil {
+				return err
+			}
+			r.recordChange("", "apikey", "delete", name)
+		}
+
+		delete(stored, name)
+		if err := writeApiKeyStore(keyStore, stored); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) getApiKeyAccountId(name string, keyConfig *ApiKeyConfig) (string, error) {
+	switch {
+	case keyConfig.Account != "" && keyConfig.Project != "":
+		return "", fmt.Errorf("API key %s can be for an account or a project, not both", name)
+	case keyConfig.Project != "":
+		project, err := r.getProjectByName(keyConfig.Project)
+		if err != nil {
+			return "", err
+		}
+		if project.Id == "" {
+			return "", fmt.Errorf("Project %s for API key %s does not exist", keyConfig.Project, name)
+		}
+		return project.Id, nil
+	case keyConfig.Account != "":
+		acct, ok := r.config.Accounts[keyConfig.Account]
+		if !ok {
+			return "", fmt.Errorf("Account %s for API key %s is not in the config", keyConfig.Account, name)
+		}
+
+		accounts, err := r.inventory.Accounts()
+		if err != nil {
+			return "", err
+		}
+		account, _, err := r.findAccount(accounts, keyConfig.Account, acct)
+		if err != nil {
+			return "", err
+		}
+		if account == nil {
+			return "", fmt.Errorf("Account %s for API key %s does not exist", keyConfig.Account, name)
+		}
+		return account.Id, nil
+	}
+
+	return "", fmt.Errorf("API key %s needs an account or a project", name)
+}
+
+func getApiKeyByName(rClient *client.RancherClient, accountId string, name string) (*client.ApiKey, error) {
+	keys, err := rClient.ApiKey.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"accountId": accountId,
+			"name":      name,
+		},
+	})
+	if err == nil {
+		err = followPages(rClient, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys.Data {
+		if key.Name == name && key.AccountId == accountId && key.State != "removed" && key.State != "purged" {
+			return &keys.Data[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func readApiKeyStore(keyStore string) (map[string]*storedApiKey, error) {
+	stored := map[string]*storedApiKey{}
+
+	file, err := os.Open(keyStore)
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return stored, err
+	}
+	defer file.Close()
+
+	decoder := candiedyaml.NewDecoder(file)
+	if err = decoder.Decode(&stored); err != nil {
+		return stored, fmt.Errorf("Could not parse keystore: %s\n%s", keyStore, err)
+	}
+
+	return stored, nil
+}
+
+func writeApiKeyStore(keyStore string, stored map[string]*storedApiKey) error {
+	fileToWrite, err := os.OpenFile(keyStore, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not write keystore: %s\n%s", keyStore, err)
+	}
+	defer fileToWrite.Close()
+
+	encoder := candiedyaml.NewEncoder(fileToWrite)
+	return encoder.Encode(stored)
+}
@@ -0,0 +1,17 @@
+package rancher
+
+// Apply configures the server to match the config. The work runs as a graph
+// of steps per project, see planGraph, with up to SetParallelism steps at a
+// time. A filter set with SetFilter limits the steps and resources touched.
+func (r *RancherServer) Apply() error {
+	nodes := r.filter.filterGraph(r.planGraph())
+	if !r.filter.empty() {
+		if len(nodes) == 0 {
+			r.log.Warnf("The filter selects nothing to configure")
+			return nil
+		}
+		r.log.Infof("Configuring only: %s", nodeNames(nodes))
+	}
+
+	return r.runGraph(nodes)
+}
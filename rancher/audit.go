@@ -0,0 +1,229 @@
+package rancher
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+// AuditQuery selects audit log entries. Zero values match everything.
+type AuditQuery struct {
+	Since        time.Time
+	Until        time.Time
+	Account      string
+	EventType    string
+	ResourceType string
+}
+
+// QueryAuditLog writes the matching audit log entries to out as a table,
+// JSON lines ("json") or CSV ("csv"). With follow set, it keeps polling for
+// new entries every interval.
+func (r *RancherServer) QueryAuditLog(query *AuditQuery, format string, out io.Writer, follow bool, interval time.Duration) error {
+	writer, err := newAuditWriter(format, out)
+	if err != nil {
+		return err
+	}
+
+	accountNames, err := r.getAccountNames()
+	if err != nil {
+		return err
+	}
+
+	filters := map[string]interface{}{
+		"sort":  "created",
+		"order": "asc",
+	}
+	if query.EventType != "" {
+		filters["eventType"] = query.EventType
+	}
+	if query.ResourceType != "" {
+		filters["resourceType"] = query.ResourceType
+	}
+	if query.Account != "" {
+		accountId, err := getAccountIdByName(accountNames, query.Account)
+		if err != nil {
+			return err
+		}
+		filters["authenticatedAsAccountId"] = accountId
+	}
+
+	since := query.Since
+	seen := map[string]bool{}
+	for {
+		if !since.IsZero() {
+			filters["created_gte"] = since.UTC().Format(time.RFC3339)
+		}
+
+		entries, err := r.listAuditLog(filters)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			created, err := time.Parse(time.RFC3339, entry.Created)
+			if err != nil {
+				logrus.Debugf("Could not parse time of audit log entry %s: %s", entry.Id, err)
+			}
+			if seen[entry.Id] || (!query.Since.IsZero() && created.Before(query.Since)) || (!query.Until.IsZero() && created.After(query.Until)) {
+				continue
+			}
+
+			if created.After(since) {
+				since = created
+				seen = map[string]bool{}
+			}
+			seen[entry.Id] = true
+
+			if err := writer.Write(entry, accountNames[entry.AuthenticatedAsAccountId]); err != nil {
+				return err
+			}
+		}
+
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+
+		if !follow {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (r *RancherServer) listAuditLog(filters map[string]interface{}) ([]client.AuditLog, error) {
+	page, err := r.client.AuditLog.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := page.Data
+	for {
+		next := &client.AuditLogCollection{}
+		more, err := getNextPage(r.client, &page.Collection, next)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return entries, nil
+		}
+		entries = append(entries, next.Data...)
+		page = next
+	}
+}
+
+func (r *RancherServer) getAccountNames() (map[string]string, error) {
+	accounts, err := r.inventory.Accounts()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	for _, account := range accounts.Data {
+		names[account.Id] = account.Name
+	}
+	return names, nil
+}
+
+func getAccountIdByName(accountNames map[string]string, name string) (string, error) {
+	accountId := ""
+	for id, accountName := range accountNames {
+		if accountName != name {
+			continue
+		}
+		if accountId != "" {
+			return "", fmt.Errorf("More than one account is named: %s", name)
+		}
+		accountId = id
+	}
+
+	if accountId == "" {
+		return "", fmt.Errorf("No account is named: %s", name)
+	}
+	return accountId, nil
+}
+
+type auditWriter interface {
+	Write(entry client.AuditLog, accountName string) error
+	Flush() error
+}
+
+func newAuditWriter(format string, out io.Writer) (auditWriter, error) {
+	switch format {
+	case "", "table":
+		w := &auditTableWriter{writer: tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)}
+		fmt.Fprintln(w.writer, "CREATED\tEVENT\tRESOURCE\tACCOUNT\tCLIENT IP\tRESPONSE")
+		return w, nil
+	case "json":
+		return &auditJSONWriter{encoder: json.NewEncoder(out)}, nil
+	case "csv":
+		w := &auditCSVWriter{writer: csv.NewWriter(out)}
+		return w, w.writer.Write([]string{"created", "event_type", "resource_type", "resource_id", "account_id", "account", "client_ip", "response_code", "request_object"})
+	}
+	return nil, fmt.Errorf("Unknown output format: %s", format)
+}
+
+type auditTableWriter struct {
+	writer *tabwriter.Writer
+}
+
+func (w *auditTableWriter) Write(entry client.AuditLog, accountName string) error {
+	_, err := fmt.Fprintf(w.writer, "%s\t%s\t%s:%d\t%s\t%s\t%s\n", entry.Created, entry.EventType, entry.ResourceType, entry.ResourceId, accountLabel(entry.AuthenticatedAsAccountId, accountName), entry.ClientIp, entry.ResponseCode)
+	return err
+}
+
+func (w *auditTableWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+type auditJSONWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *auditJSONWriter) Write(entry client.AuditLog, accountName string) error {
+	return w.encoder.Encode(struct {
+		client.AuditLog
+		AccountName string `json:"accountName,omitempty"`
+	}{entry, accountName})
+}
+
+func (w *auditJSONWriter) Flush() error {
+	return nil
+}
+
+type auditCSVWriter struct {
+	writer *csv.Writer
+}
+
+func (w *auditCSVWriter) Write(entry client.AuditLog, accountName string) error {
+	return w.writer.Write([]string{
+		entry.Created,
+		entry.EventType,
+		entry.ResourceType,
+		fmt.Sprintf("%d", entry.ResourceId),
+		entry.AuthenticatedAsAccountId,
+		accountName,
+		entry.ClientIp,
+		entry.ResponseCode,
+		entry.RequestObject,
+	})
+}
+
+func (w *auditCSVWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func accountLabel(accountId string, accountName string) string {
+	if accountName == "" {
+		return accountId
+	}
+	return accountName + " (" + accountId + ")"
+}
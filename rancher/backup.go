@@ -0,0 +1,580 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// Backup is the server side state of what rbs manages, as it was before a
+// run. Secrets are left out, the server does not hand them out.
+type Backup struct {
+	Created    time.Time          `json:"created"`
+	Server     string             `json:"server"`
+	Settings   map[string]string  `json:"settings"`
+	LdapConfig *client.Ldapconfig `json:"ldapConfig,omitempty"`
+	Accounts   []client.Account   `json:"accounts"`
+	Projects   []*ProjectBackup   `json:"projects"`
+}
+
+// ProjectBackup is a project with its members and registries. Registries
+// are nil for projects that were not active, they could not be listed.
+type ProjectBackup struct {
+	Project    client.Project         `json:"project"`
+	Members    []client.ProjectMember `json:"members"`
+	Registries []*RegistryBackup      `json:"registries"`
+}
+
+// RegistryBackup is a registry with the metadata of its credentials.
+type RegistryBackup struct {
+	Registry    client.Registry             `json:"registry"`
+	Credentials []client.RegistryCredential `json:"credentials"`
+}
+
+func (b *Backup) project(id string) *ProjectBackup {
+	for _, project := range b.Projects {
+		if project.Project.Id == id {
+			return project
+		}
+	}
+	return nil
+}
+
+func (b *Backup) account(id string) *client.Account {
+	for i, account := range b.Accounts {
+		if account.Id == id {
+			return &b.Accounts[i]
+		}
+	}
+	return nil
+}
+
+func (p *ProjectBackup) registry(serverAddress string) *RegistryBackup {
+	for _, registry := range p.Registries {
+		if registry.Registry.ServerAddress == serverAddress {
+			return registry
+		}
+	}
+	return nil
+}
+
+func (g *RegistryBackup) credential(publicValue string) *client.RegistryCredential {
+	for i, credential := range g.Credentials {
+		if credential.PublicValue == publicValue {
+			return &g.Credentials[i]
+		}
+	}
+	return nil
+}
+
+// SetBackups makes every run write a backup to dir before it changes
+// anything. With revert, a run that fails is rolled back to that backup.
+func (r *RancherServer) SetBackups(dir string, revert bool) {
+	r.backupDir = dir
+	r.revertOnFailure = revert
+}
+
+// applyWithBackup runs apply after writing a backup, if backups are on. The
+// backup is dropped again when the run changed nothing.
+func (r *RancherServer) applyWithBackup(apply func() error) error {
+	if r.backupDir == "" {
+		return apply()
+	}
+
+	backup, path, err := r.TakeBackup(r.backupDir)
+	if err != nil {
+		return fmt.Errorf("Could not back up the server, not applying\n%s", err)
+	}
+
+	err = apply()
+	if err == nil && len(r.Changes()) == 0 {
+		os.Remove(path)
+		return nil
+	}
+	if err == nil || !r.revertOnFailure {
+		return err
+	}
+
+	r.log.Warnf("Run failed, reverting to backup: %s", path)
+	if revertErr := r.restore(backup); revertErr != nil {
+		return fmt.Errorf("%s\nReverting failed too: %s", err, revertErr)
+	}
+	return err
+}
+
+// TakeBackup writes the current state of the server to a new timestamped
+// file in dir and returns it.
+func (r *RancherServer) TakeBackup(dir string) (*Backup, string, error) {
+	backup, err := r.snapshot()
+	if err != nil {
+		return nil, "", err
+	}
+
+	host := r.config.Server.URL
+	if serverURL, err := url.Parse(host); err == nil && serverURL.Host != "" {
+		host = serverURL.Host
+	}
+	path := filepath.Join(dir, fmt.Sprintf("rbs-backup-%s-%s.json", host, backup.Created.Format("20060102T150405Z")))
+
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, "", fmt.Errorf("Could not write backup: %s\n%s", path, err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, "", fmt.Errorf("Could not write backup: %s\n%s", path, err)
+	}
+
+	r.log.Infof("Backed up the server to: %s", path)
+	return backup, path, nil
+}
+
+// LoadBackup reads a backup written by TakeBackup.
+func LoadBackup(path string) (*Backup, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("File does not exist: %s\n%s", path, err)
+	}
+
+	backup := &Backup{}
+	if err := json.Unmarshal(data, backup); err != nil {
+		return nil, fmt.Errorf("Could not parse backup: %s\n%s", path, err)
+	}
+	return backup, nil
+}
+
+func (r *RancherServer) snapshot() (*Backup, error) {
+	backup := &Backup{
+		Created:  time.Now().UTC(),
+		Server:   r.config.Server.URL,
+		Settings: map[string]string{},
+	}
+
+	settings, err := r.client.Setting.List(&client.ListOpts{})
+	if err == nil {
+		err = followPages(r.client, settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range settings.Data {
+		if setting.Name != lockSettingName {
+			backup.Settings[setting.Name] = setting.Value
+		}
+	}
+
+	ldapconfigs, err := r.client.Ldapconfig.List(&client.ListOpts{})
+	if err != nil {
+		return nil, err
+	}
+	if len(ldapconfigs.Data) > 0 {
+		ldapconfig := ldapconfigs.Data[0]
+		ldapconfig.ServiceAccountPassword = ""
+		backup.LdapConfig = &ldapconfig
+	}
+
+	accounts, err := r.inventory.Accounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts.Data {
+		if (account.Kind == "admin" || account.Kind == "user") && account.State != "removed" && account.State != "purged" {
+			backup.Accounts = append(backup.Accounts, account)
+		}
+	}
+
+	projects, err := r.inventory.Projects()
+	if err != nil {
+		return nil, err
+	}
+	for i := range projects.Data {
+		project := &projects.Data[i]
+		if project.State == "removed" || project.State == "purged" {
+			continue
+		}
+
+		projectBackup, err := r.snapshotProject(project)
+		if err != nil {
+			return nil, fmt.Errorf("Could not back up project %s\n%s", project.Name, err)
+		}
+		backup.Projects = append(backup.Projects, projectBackup)
+	}
+
+	return backup, nil
+}
+
+func (r *RancherServer) snapshotProject(project *client.Project) (*ProjectBackup, error) {
+	members, err := getProjectMembers(project, r.client)
+	if err != nil {
+		return nil, err
+	}
+
+	projectBackup := &ProjectBackup{
+		Project: *project,
+		Members: members,
+	}
+	if project.State != "active" {
+		return projectBackup, nil
+	}
+
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return nil, err
+	}
+	registries, err := r.inventory.Registries(projectClient, project)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := r.inventory.RegistryCredentials(projectClient, project)
+	if err != nil {
+		return nil, err
+	}
+
+	projectBackup.Registries = []*RegistryBackup{}
+	for _, registry := range registries.Data {
+		if registry.State == "removed" || registry.State == "purged" {
+			continue
+		}
+
+		registryBackup := &RegistryBackup{Registry: registry}
+		for _, credential := range credentials.Data {
+			if credential.RegistryId != registry.Id || credential.Kind != "registryCredential" || credential.State == "removed" || credential.State == "purged" {
+				continue
+			}
+			credential.SecretValue = ""
+			registryBackup.Credentials = append(registryBackup.Credentials, credential)
+		}
+		projectBackup.Registries = append(projectBackup.Registries, registryBackup)
+	}
+
+	return projectBackup, nil
+}
+
+// Rollback restores the server to backup and reports the run like ApplyOnce
+// does. It takes a backup first like any run, but never reverts itself.
+func (r *RancherServer) Rollback(backup *Backup) *RunStatus {
+	if backup.Server != r.config.Server.URL {
+		status := &RunStatus{Started: time.Now(), Finished: time.Now()}
+		status.Error = fmt.Sprintf("Backup is of %s, not %s", backup.Server, r.config.Server.URL)
+		return status
+	}
+
+	rollback := *r
+	rollback.revertOnFailure = false
+	return rollback.runOnce(func() error {
+		return rollback.restore(backup)
+	}, nil)
+}
+
+// restore brings the server back to backup. Projects, accounts and
+// registries go through the same steps as the config, driven by a config
+// made from the backup. Resources created by rbs since are removed, others
+// are left alone. Members, credential metadata, settings and auth are
+// restored directly.
+func (r *RancherServer) restore(backup *Backup) error {
+	r.inventory.Reset()
+	current, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+
+	rollback := *r
+	rollback.config, rollback.state = backup.rollbackConfig(current, r.config.Server)
+	rollback.filter = &nodeFilter{}
+	rollback.log.Infof("Rolling back to the backup of %s", backup.Created.Format(time.RFC3339))
+
+	if err := rollback.runGraph(rollback.planGraph()); err != nil {
+		return err
+	}
+
+	if err := rollback.restoreMembers(backup); err != nil {
+		return err
+	}
+	if err := rollback.restoreCredentials(backup, current); err != nil {
+		return err
+	}
+	if err := rollback.restoreSettings(backup, current); err != nil {
+		return err
+	}
+	return rollback.restoreAuth(backup, current)
+}
+
+// rollbackConfig returns a config that brings the server from current back
+// to b. Projects and accounts are keyed by their ID, the state returned
+// ties those keys to them.
+func (b *Backup) rollbackConfig(current *Backup, server *RancherServerConfig) (*RancherBootstrapConfig, *state) {
+	config := &RancherBootstrapConfig{
+		Server:              server,
+		Accounts:            map[string]*Account{},
+		Projects:            map[string]*Project{},
+		Registries:          map[string][]client.Registry{},
+		RegistryCredentials: map[string]map[string][]*RegistryCredential{},
+	}
+	ids := newMemoryState()
+
+	for _, account := range b.Accounts {
+		if current.account(account.Id) == nil {
+			continue
+		}
+		config.Accounts[account.Id] = &Account{
+			Account: client.Account{
+				ExternalId:     account.ExternalId,
+				ExternalIdType: account.ExternalIdType,
+				Kind:           account.Kind,
+				Name:           account.Name,
+				State:          account.State,
+			},
+		}
+		ids.data.Accounts[account.Id] = account.Id
+	}
+	for _, account := range current.Accounts {
+		if b.account(account.Id) == nil && isManaged(account.Description, account.Data) {
+			config.Accounts[account.Id] = &Account{
+				Account: client.Account{
+					ExternalId: account.ExternalId,
+					Name:       account.Name,
+					State:      "Purged",
+				},
+			}
+			ids.data.Accounts[account.Id] = account.Id
+		}
+	}
+
+	for _, projectBackup := range b.Projects {
+		project := projectBackup.Project
+		publicDns := project.PublicDns
+		config.Projects[project.Id] = &Project{
+			Project: client.Project{
+				Name:              project.Name,
+				Description:       unmarkedDescription(project.Description),
+				ServicesPortRange: project.ServicesPortRange,
+				Kubernetes:        project.Kubernetes,
+				Swarm:             project.Swarm,
+			},
+			PublicDns: &publicDns,
+		}
+		ids.data.Projects[project.Id] = project.Id
+
+		if projectBackup.Registries == nil {
+			continue
+		}
+		registries := []client.Registry{}
+		for _, registry := range projectBackup.Registries {
+			registries = append(registries, client.Registry{
+				Name:          registry.Registry.Name,
+				Description:   unmarkedDescription(registry.Registry.Description),
+				ServerAddress: registry.Registry.ServerAddress,
+			})
+		}
+		config.Registries[project.Name] = registries
+	}
+
+	for _, projectCurrent := range current.Projects {
+		project := projectCurrent.Project
+		projectBackup := b.project(project.Id)
+		if projectBackup == nil {
+			if isManaged(project.Description, project.Data) {
+				config.Projects[project.Id] = &Project{
+					Project: client.Project{
+						Name:  project.Name,
+						State: "Purged",
+					},
+				}
+				ids.data.Projects[project.Id] = project.Id
+			}
+			continue
+		}
+		if projectBackup.Registries == nil {
+			continue
+		}
+
+		name := projectBackup.Project.Name
+		for _, registry := range projectCurrent.Registries {
+			registryBackup := projectBackup.registry(registry.Registry.ServerAddress)
+			if registryBackup == nil {
+				if isManaged(registry.Registry.Description, registry.Registry.Data) {
+					config.Registries[name] = append(config.Registries[name], client.Registry{
+						ServerAddress: registry.Registry.ServerAddress,
+						State:         "Purged",
+					})
+				}
+				continue
+			}
+
+			for _, credential := range registry.Credentials {
+				if registryBackup.credential(credential.PublicValue) != nil || !isManaged(credential.Description, credential.Data) {
+					continue
+				}
+				if config.RegistryCredentials[name] == nil {
+					config.RegistryCredentials[name] = map[string][]*RegistryCredential{}
+				}
+				address := registry.Registry.ServerAddress
+				config.RegistryCredentials[name][address] = append(config.RegistryCredentials[name][address], &RegistryCredential{
+					RegistryCredential: client.RegistryCredential{
+						PublicValue: credential.PublicValue,
+						State:       "Purged",
+					},
+				})
+			}
+		}
+	}
+
+	return config, ids
+}
+
+// restoreMembers sets the members of every backed up project that still
+// exists to the ones it had.
+func (r *RancherServer) restoreMembers(backup *Backup) error {
+	for _, projectBackup := range backup.Projects {
+		project, err := r.client.Project.ById(projectBackup.Project.Id)
+		if err != nil {
+			return err
+		}
+		if project == nil || project.State == "removed" || project.State == "purged" {
+			continue
+		}
+
+		members, err := getProjectMembers(project, r.client)
+		if err != nil {
+			return err
+		}
+		if sameMembers(members, projectBackup.Members) {
+			continue
+		}
+
+		restored := []client.ProjectMember{}
+		for _, member := range projectBackup.Members {
+			restored = append(restored, client.ProjectMember{
+				ExternalId:     member.ExternalId,
+				ExternalIdType: member.ExternalIdType,
+				Role:           member.Role,
+			})
+		}
+
+		r.log.Infof("Restoring members of project: %s", project.Name)
+		if _, err := r.client.Project.ActionSetmembers(project, &client.SetProjectMembersInput{Members: restored}); err != nil {
+			return err
+		}
+		r.recordChange(project.Name, "projectmembers", "update", project.Name)
+	}
+	return nil
+}
+
+func sameMembers(a []client.ProjectMember, b []client.ProjectMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, member := range a {
+		if !projectMemberExists(b, member) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreCredentials puts back the email of backed up credentials. Those
+// removed since can not be restored, the backup has no secrets.
+func (r *RancherServer) restoreCredentials(backup *Backup, current *Backup) error {
+	for _, projectBackup := range backup.Projects {
+		projectCurrent := current.project(projectBackup.Project.Id)
+		if projectCurrent == nil || projectBackup.Registries == nil || projectCurrent.Registries == nil {
+			continue
+		}
+
+		for _, registryBackup := range projectBackup.Registries {
+			registryCurrent := projectCurrent.registry(registryBackup.Registry.ServerAddress)
+
+			for _, credential := range registryBackup.Credentials {
+				name := registryBackup.Registry.ServerAddress + "/" + credential.PublicValue
+
+				var existing *client.RegistryCredential
+				if registryCurrent != nil {
+					existing = registryCurrent.credential(credential.PublicValue)
+				}
+				if existing == nil {
+					r.log.Warnf("Credentials for %s were removed and can not be restored, backups hold no secrets", name)
+					continue
+				}
+				if existing.Email == credential.Email {
+					continue
+				}
+
+				projectClient, err := r.projectClients.Get(&projectCurrent.Project, r.log)
+				if err != nil {
+					return err
+				}
+				r.log.Infof("Restoring credentials for: %s", name)
+				if _, err := projectClient.RegistryCredential.Update(existing, map[string]interface{}{
+					"email": credential.Email,
+				}); err != nil {
+					return err
+				}
+				r.recordChange(projectBackup.Project.Name, "registrycredential", "update", name)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreSettings puts back the settings whose value changed.
+func (r *RancherServer) restoreSettings(backup *Backup, current *Backup) error {
+	names := []string{}
+	for name := range backup.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := backup.Settings[name]
+		if currentValue, ok := current.Settings[name]; !ok || currentValue == value {
+			continue
+		}
+
+		setting, err := r.client.Setting.ById(name)
+		if err != nil {
+			return err
+		}
+		if setting == nil {
+			continue
+		}
+
+		r.log.Infof("Restoring setting: %s", name)
+		if _, err := r.client.Setting.Update(setting, map[string]interface{}{
+			"value": value,
+		}); err != nil {
+			return err
+		}
+		r.recordChange("", "setting", "update", name)
+	}
+	return nil
+}
+
+// restoreAuth disables LDAP if it was enabled since. Enabling it again needs
+// the service account password, which is only in the config.
+func (r *RancherServer) restoreAuth(backup *Backup, current *Backup) error {
+	wasEnabled := backup.LdapConfig != nil && backup.LdapConfig.Enabled
+	isEnabled := current.LdapConfig != nil && current.LdapConfig.Enabled
+
+	switch {
+	case wasEnabled && !isEnabled:
+		r.log.Warnf("LDAP was enabled at the time of the backup, apply the config to enable it again")
+	case !wasEnabled && isEnabled:
+		r.log.Infof("Disabling Ldap config")
+		if err := r.client.Create(client.LDAPCONFIG_TYPE, map[string]interface{}{
+			"enabled": false,
+		}, &client.Ldapconfig{}); err != nil {
+			return err
+		}
+		r.recordChange("", "ldapconfig", "update", current.LdapConfig.Server)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestRollback(t *testing.T) {
+	config := registryConfig()
+	config.Projects["dev"].Description = "Development"
+	s := newTestServer(t, config)
+	defer s.Close()
+	s.fake.Add("setting", &client.Setting{Name: "telemetry.opt", Value: "in"})
+	s.apply(t)
+
+	_, path, err := s.TakeBackup(filepath.Join(s.dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := LoadBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential := backup.Projects[0].Registries[0].Credentials[0]; credential.PublicValue != "ci" || credential.SecretValue != "" {
+		t.Fatalf("Expected the credential without its secret, got %#v", credential)
+	}
+
+	s.config.Projects["dev"].Description = "Changed"
+	s.config.Projects["qa"] = &Project{Project: client.Project{Name: "qa"}}
+	s.config.Registries["dev"] = append(s.config.Registries["dev"], client.Registry{ServerAddress: "mirror.example.com"})
+	s.apply(t)
+	settings := []client.Setting{}
+	s.fake.List("setting", &settings)
+	s.fake.Update("setting", settings[0].Id, map[string]interface{}{"value": "out"})
+
+	if status := s.Rollback(backup); !status.Success {
+		t.Fatalf("Rollback failed: %s", status.Error)
+	}
+
+	projects := s.projects()
+	if len(projects) != 1 || unmarkedDescription(projects[0].Description) != "Development" {
+		t.Fatalf("Expected dev as it was, got %#v", projects)
+	}
+	registries, credentials := s.registries()
+	if len(registries) != 1 || registries[0].ServerAddress != "registry.example.com" || len(credentials) != 1 {
+		t.Fatalf("Expected the registry as it was, got %#v and %#v", registries, credentials)
+	}
+	s.fake.List("setting", &settings)
+	if settings[0].Value != "in" {
+		t.Fatalf("Setting not restored: %#v", settings[0])
+	}
+}
+
+func TestRollbackChecksServer(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	if status := s.Rollback(&Backup{Server: "https://elsewhere.example.com/v1"}); status.Success {
+		t.Fatalf("Expected a backup of another server to be refused")
+	}
+}
+
+func TestRevertOnFailure(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	dir := filepath.Join(s.dir, "backups")
+	s.SetBackups(dir, true)
+
+	s.fake.Fail("POST", "registry", http.StatusInternalServerError)
+	if status := s.ApplyOnce(); status.Success {
+		t.Fatalf("Expected the run to fail")
+	}
+
+	if projects := s.projects(); len(projects) != 0 {
+		t.Fatalf("Expected the project created by the failed run to be removed, got %#v", projects)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected the backup to be kept, got %d files", len(files))
+	}
+}
+
+func TestBackupDroppedWithoutChanges(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+	dir := filepath.Join(s.dir, "backups")
+	s.SetBackups(dir, false)
+
+	s.apply(t)
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected no backup, got %d files", len(files))
+	}
+}
@@ -0,0 +1,169 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+type catalogTemplateVersion struct {
+	Files map[string]string `json:"files"`
+}
+
+// ConfigureCatalog installs the configured catalog templates as stacks and
+// upgrades them when their version or answers change.
+func (r *RancherServer) ConfigureCatalog() error {
+	for projectName, stacks := range r.config.Catalog {
+		if err := r.configureProjectCatalog(projectName, stacks); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureProjectCatalog(projectName string, stacks map[string]*CatalogStack) error {
+	r.log.Infof("Configuring catalog stacks for project: %s", projectName)
+	project, err := r.getProjectByName(projectName)
+	if err != nil {
+		return err
+	}
+	if project.Id == "" {
+		return fmt.Errorf("Project %s does not exist", projectName)
+	}
+
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range stacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !r.selected("catalog", name) {
+			continue
+		}
+		if err := r.configureCatalogStack(projectClient, projectName, name, stacks[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureCatalogStack(prjClient *client.RancherClient, projectName string, name string, catalogStack *CatalogStack) error {
+	externalId := catalogStack.externalId()
+
+	answers := map[string]interface{}{}
+	for key, value := range catalogStack.Answers {
+		answer, err := resolveSecret(value)
+		if err != nil {
+			return err
+		}
+		answers[key] = answer
+	}
+
+	existing, err := getStackByName(prjClient, name)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && existing.ExternalId == externalId && !answersChanged(existing.Environment, answers) {
+		return nil
+	}
+
+	templateVersion, err := r.getCatalogTemplateVersion(catalogStack.templateVersionId())
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		r.log.Infof("Installing %s as stack: %s", externalId, name)
+		stack, err := prjClient.Environment.Create(&client.Environment{
+			Name:           name,
+			ExternalId:     externalId,
+			DockerCompose:  templateVersion.Files["docker-compose.yml"],
+			RancherCompose: templateVersion.Files["rancher-compose.yml"],
+			Environment:    answers,
+			StartOnCreate:  true,
+		})
+		if err != nil {
+			return err
+		}
+		if err := waitForStack(prjClient, stack); err != nil {
+			return err
+		}
+		r.recordChange(projectName, "stack", "create", name)
+		return nil
+	}
+
+	err = r.upgradeStack(prjClient, existing, &client.EnvironmentUpgrade{
+		ExternalId:     externalId,
+		DockerCompose:  templateVersion.Files["docker-compose.yml"],
+		RancherCompose: templateVersion.Files["rancher-compose.yml"],
+		Environment:    answers,
+	}, catalogStack.Upgrade)
+	if err != nil {
+		return err
+	}
+	r.recordChange(projectName, "stack", "update", name)
+	return nil
+}
+
+// getCatalogTemplateVersion fetches the compose files of a template version
+// from the catalog service, which lives next to the /v1 API.
+func (r *RancherServer) getCatalogTemplateVersion(templateVersionId string) (*catalogTemplateVersion, error) {
+	baseURL := strings.TrimSuffix(strings.TrimRight(r.config.Server.URL, "/"), "/v1")
+	templateURL := baseURL + "/v1-catalog/templates/" + templateVersionId
+
+	req, err := http.NewRequest("GET", templateURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(r.client.Opts.AccessKey, r.client.Opts.SecretKey)
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not get catalog template %s: %s", templateVersionId, resp.Status)
+	}
+
+	templateVersion := &catalogTemplateVersion{}
+	if err := json.NewDecoder(resp.Body).Decode(templateVersion); err != nil {
+		return nil, err
+	}
+	if templateVersion.Files["docker-compose.yml"] == "" {
+		return nil, fmt.Errorf("Catalog template %s has no docker-compose.yml", templateVersionId)
+	}
+
+	return templateVersion, nil
+}
+
+// answersChanged tells whether the answers of a stack differ from the
+// configured ones, including answers the config no longer has.
+func answersChanged(existing map[string]interface{}, answers map[string]interface{}) bool {
+	if len(existing) != len(answers) {
+		return true
+	}
+	for key, value := range answers {
+		current, ok := existing[key]
+		if !ok || fmt.Sprintf("%v", current) != fmt.Sprintf("%v", value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func catalogConfig() *RancherBootstrapConfig {
+	return &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Catalog: map[string]map[string]*CatalogStack{
+			"dev": {
+				"cache": {
+					Template: "redis",
+					Version:  "1",
+					Answers:  map[string]string{"PORT": "6379", "PASSWORD": "s3cret"},
+				},
+			},
+		},
+	}
+}
+
+func newCatalogServer(t *testing.T) *testServer {
+	s := newTestServer(t, catalogConfig())
+	s.fake.AddTemplate("library:redis:1", map[string]string{"docker-compose.yml": "redis:\n  image: redis:3\n"})
+	s.fake.AddTemplate("library:redis:2", map[string]string{"docker-compose.yml": "redis:\n  image: redis:4\n"})
+	return s
+}
+
+func TestApplyInstallsCatalogStacks(t *testing.T) {
+	s := newCatalogServer(t)
+	defer s.Close()
+
+	s.apply(t)
+	stacks := s.stacks()
+	if len(stacks) != 1 || stacks[0].ExternalId != "catalog://library:redis:1" || stacks[0].DockerCompose != "redis:\n  image: redis:3\n" || stacks[0].Environment["PORT"] != "6379" {
+		t.Fatalf("Unexpected stacks: %#v", stacks)
+	}
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+
+	// An answer dropped from the config is dropped from the stack too.
+	delete(s.config.Catalog["dev"]["cache"].Answers, "PASSWORD")
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected the stack upgraded, got %v", status.Changes)
+	}
+	if _, ok := s.stacks()[0].Environment["PASSWORD"]; ok {
+		t.Fatalf("Answer kept: %#v", s.stacks()[0].Environment)
+	}
+
+	s.config.Catalog["dev"]["cache"].Version = "2"
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected the stack upgraded, got %v", status.Changes)
+	}
+	if stack := s.stacks()[0]; stack.ExternalId != "catalog://library:redis:2" || stack.DockerCompose != "redis:\n  image: redis:4\n" {
+		t.Fatalf("Unexpected stack: %#v", stack)
+	}
+}
+
+func TestApplyRollsBackCatalogUpgrades(t *testing.T) {
+	s := newCatalogServer(t)
+	defer s.Close()
+	s.apply(t)
+	s.addService("redis", "redis:3", "unhealthy")
+
+	stack := s.config.Catalog["dev"]["cache"]
+	stack.Version = "2"
+	stack.Upgrade = &UpgradeStrategy{Timeout: "50ms"}
+	before := len(s.fake.Requests())
+	if status := s.ApplyOnce(); status.Success || !strings.Contains(status.Error, "did not become healthy within 50ms: redis") {
+		t.Fatalf("Expected the upgrade to time out, got %s", status.Error)
+	}
+	if actions := strings.Join(s.actions(before), ", "); actions != "upgrade, rollback" {
+		t.Fatalf("Expected upgrade, rollback, got %s", actions)
+	}
+	if stack := s.stacks()[0]; stack.State != "active" || stack.ExternalId != "catalog://library:redis:1" {
+		t.Fatalf("Unexpected stack after the rollback: %#v", stack)
+	}
+}
+
+func TestAnswersChanged(t *testing.T) {
+	existing := map[string]interface{}{"PORT": "6379", "DEBUG": "true"}
+	for _, test := range []struct {
+		answers map[string]interface{}
+		changed bool
+	}{
+		{map[string]interface{}{"PORT": "6379", "DEBUG": "true"}, false},
+		{map[string]interface{}{"PORT": "6380", "DEBUG": "true"}, true},
+		{map[string]interface{}{"PORT": "6379"}, true},
+		{map[string]interface{}{"PORT": "6379", "DEBUG": "true", "NEW": "1"}, true},
+	} {
+		if changed := answersChanged(existing, test.answers); changed != test.changed {
+			t.Errorf("Expected %v for %v, got %v", test.changed, test.answers, changed)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package rancher
+
+import "sync"
+
+// Change is a modification rbs made to bring the server in line with the
+// config. The changes of a run are the drift it found.
+type Change struct {
+	Project string `json:"project,omitempty"`
+	Kind    string `json:"kind"`
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+}
+
+type changeLog struct {
+	sync.Mutex
+	changes []Change
+}
+
+// recordChange notes a write rbs made. Every write is recorded, which also
+// makes this the place to drop inventory the write made stale.
+func (r *RancherServer) recordChange(project string, kind string, action string, name string) {
+	r.inventory.invalidate(project, kind)
+
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	r.changes.changes = append(r.changes.changes, Change{
+		Project: project,
+		Kind:    kind,
+		Action:  action,
+		Name:    name,
+	})
+}
+
+// Changes returns the changes made since the last call to ResetChanges.
+func (r *RancherServer) Changes() []Change {
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	return append([]Change{}, r.changes.changes...)
+}
+
+func (r *RancherServer) ResetChanges() {
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	r.changes.changes = nil
+}
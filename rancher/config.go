@@ -1,6 +1,12 @@
 package rancher
 
-import "github.com/rancher/go-rancher/client"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
 
 type RancherServerConfig struct {
 	URL string
@@ -9,9 +15,125 @@ type RancherServerConfig struct {
 type RancherBootstrapConfig struct {
 	Server              *RancherServerConfig
 	LdapConfig          *client.Ldapconfig
-	Accounts            map[string]*client.Account
-	Projects            map[string]*client.Project
+	Accounts            map[string]*Account
+	Projects            map[string]*Project
 	Memberships         map[string]map[string]*client.Identity `json:"memberships" yaml:"memberships"`
 	Registries          map[string][]client.Registry           `yaml:"registries"`
-	RegistryCredentials map[string]map[string][]*client.RegistryCredential
+	RegistryCredentials map[string]map[string][]*RegistryCredential
+	Volumes             map[string][]*client.Volume
+	Prepull             map[string][]*client.PullTask
+	Catalog             map[string]map[string]*CatalogStack
+	Stacks              map[string]map[string]*Stack
+	ApiKeys             *ApiKeysConfig `yaml:"apikeys"`
+}
+
+// Account is an account entry in the config. Accounts with a Username are
+// local accounts logging in with a password, all others are LDAP backed.
+type Account struct {
+	client.Account
+
+	Username string `yaml:"username"`
+
+	// Password is a secret reference, see resolveSecret.
+	Password string `yaml:"password"`
+
+	RotatePassword bool `yaml:"rotate_password"`
+}
+
+func (a *Account) isLocal() bool {
+	return a.Username != ""
+}
+
+// Project is a project entry in the config.
+type Project struct {
+	client.Project
+
+	// PublicDns is only changed on the server when the config sets it.
+	PublicDns *bool `yaml:"public_dns"`
+}
+
+// RegistryCredential is a registry credential entry in the config. With
+// Verify set, the credential is used to log in to the registry before it is
+// saved.
+type RegistryCredential struct {
+	client.RegistryCredential
+
+	Verify bool `yaml:"verify"`
+}
+
+// CatalogStack is a stack launched from a catalog template. Template is
+// either <catalog>:<template> or a template in the library catalog. Answer
+// values may be secret references.
+type CatalogStack struct {
+	Template string            `yaml:"template"`
+	Version  string            `yaml:"version"`
+	Answers  map[string]string `yaml:"answers"`
+	Upgrade  *UpgradeStrategy  `yaml:"upgrade"`
+}
+
+func (c *CatalogStack) templateVersionId() string {
+	template := c.Template
+	if !strings.Contains(template, ":") {
+		template = "library:" + template
+	}
+	return template + ":" + c.Version
+}
+
+func (c *CatalogStack) externalId() string {
+	return "catalog://" + c.templateVersionId()
+}
+
+// Stack is a stack defined by its compose files, which may be given inline or
+// as file: references. Services pins the image of individual services.
+type Stack struct {
+	DockerCompose  string                   `yaml:"docker_compose,omitempty"`
+	RancherCompose string                   `yaml:"rancher_compose,omitempty"`
+	Environment    map[string]string        `yaml:"environment,omitempty"`
+	Services       map[string]*StackService `yaml:"services,omitempty"`
+	Upgrade        *UpgradeStrategy         `yaml:"upgrade,omitempty"`
+}
+
+type StackService struct {
+	Image string `yaml:"image"`
+}
+
+// UpgradeStrategy controls how upgrades are rolled out. Batch size, interval
+// and start first apply to service upgrades. An upgrade that is not healthy
+// within Timeout is rolled back, or cancelled when OnFailure is "cancel".
+type UpgradeStrategy struct {
+	BatchSize      int64  `yaml:"batch_size"`
+	IntervalMillis int64  `yaml:"interval_millis"`
+	StartFirst     bool   `yaml:"start_first"`
+	Timeout        string `yaml:"timeout"`
+	OnFailure      string `yaml:"on_failure"`
+}
+
+func (u *UpgradeStrategy) timeout() (time.Duration, error) {
+	if u == nil || u.Timeout == "" {
+		return stackHealthTimeout, nil
+	}
+	timeout, err := time.ParseDuration(u.Timeout)
+	if err != nil {
+		return timeout, fmt.Errorf("Invalid upgrade timeout: %s", u.Timeout)
+	}
+	return timeout, nil
+}
+
+func (u *UpgradeStrategy) rollback() bool {
+	return u == nil || u.OnFailure != "cancel"
+}
+
+// ApiKeysConfig declares named API keys, keyed by name. Their secrets are
+// written to KeyStore.
+type ApiKeysConfig struct {
+	KeyStore string                   `yaml:"keystore"`
+	Keys     map[string]*ApiKeyConfig `yaml:"keys"`
+}
+
+// ApiKeyConfig is a key for either an account, by its key in accounts, or a
+// project, by name.
+type ApiKeyConfig struct {
+	Account     string `yaml:"account"`
+	Project     string `yaml:"project"`
+	Description string `yaml:"description"`
 }
@@ -0,0 +1,264 @@
+package rancher
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// configSettleDelay lets an editor finish saving the config before it
+	// is read.
+	configSettleDelay = 500 * time.Millisecond
+
+	// configPollInterval is how often the config is checked when its
+	// directory can not be watched.
+	configPollInterval = 5 * time.Second
+)
+
+// RunStatus is the outcome of a reconcile run.
+type RunStatus struct {
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Targets    []string  `json:"targets,omitempty"`
+	DriftCount int       `json:"driftCount"`
+	Changes    []Change  `json:"changes,omitempty"`
+}
+
+type daemon struct {
+	sync.Mutex
+	server     *RancherServer
+	configFile string
+	lastRun    *RunStatus
+
+	subscriptions *eventSubscriptions
+}
+
+// Serve reconciles the server every interval until the process exits. The
+// config file is re-read when it changes on disk, which also triggers a run.
+// With watchEvents set, changes made to projects, members, registries and
+// settings are reconciled as soon as the server reports them, and interval
+// only paces the full resync. /healthz, /status, with the result of the last
+// run, and Prometheus /metrics are served on listen.
+func (r *RancherServer) Serve(configFile string, interval time.Duration, listen string, watchEvents bool) error {
+	d := &daemon{
+		server:     r,
+		configFile: configFile,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	errs := make(chan error, 1)
+	go func() {
+		logrus.Infof("Listening on: %s", listen)
+		errs <- http.ListenAndServe(listen, mux)
+	}()
+
+	return d.loop(interval, watchEvents, errs)
+}
+
+// loop runs the daemon until stop delivers an error, which it returns.
+func (d *daemon) loop(interval time.Duration, watchEvents bool, stop <-chan error) error {
+	r := d.server
+	configFile := d.configFile
+
+	configChanged := make(chan bool)
+	go watchFile(configFile, configChanged)
+
+	var events chan resourceChangeEvent
+	if watchEvents {
+		d.subscriptions = newEventSubscriptions(r.client)
+		defer d.subscriptions.Close()
+		events = d.subscriptions.events
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := map[reconcileTarget]bool{}
+	var settled <-chan time.Time
+
+	d.run()
+	for {
+		select {
+		case err := <-stop:
+			return err
+		case <-configChanged:
+			logrus.Infof("Config changed, reloading: %s", configFile)
+			if err := r.ReloadConfig(configFile); err != nil {
+				logrus.Errorf("Could not reload config, keeping the previous one: %s", err)
+				continue
+			}
+			d.run()
+		case <-ticker.C:
+			d.run()
+		case event := <-events:
+			target, ok := r.eventTarget(event)
+			if !ok || !r.filter.selectsNode(target.nodeKind(), target.project) {
+				continue
+			}
+			logrus.Debugf("%s %s changed, reconciling %s", event.ResourceType, event.ResourceId, target)
+			pending[target] = true
+			if settled == nil {
+				settled = time.After(eventSettleDelay)
+			}
+		case <-settled:
+			d.reconcile(sortedTargets(pending))
+			pending = map[reconcileTarget]bool{}
+			settled = nil
+		}
+	}
+}
+
+// run reconciles everything, then subscribes to the projects the config
+// now manages.
+func (d *daemon) run() {
+	d.record(d.server.runOnce(d.server.Apply, nil))
+
+	if d.subscriptions == nil {
+		return
+	}
+	projects, err := d.server.eventProjects()
+	if err != nil {
+		logrus.Errorf("Could not list projects to subscribe to: %s", err)
+		return
+	}
+	d.subscriptions.Sync(projects)
+}
+
+func (d *daemon) reconcile(targets []reconcileTarget) {
+	d.record(d.server.runOnce(func() error {
+		return d.server.reconcile(targets)
+	}, targets))
+}
+
+func (d *daemon) record(status *RunStatus) {
+	if status.Success {
+		logrus.Infof("Run finished, %d change(s)", status.DriftCount)
+	} else {
+		logrus.Errorf("Run failed after %d change(s): %s", status.DriftCount, status.Error)
+	}
+
+	d.Lock()
+	d.lastRun = status
+	d.Unlock()
+}
+
+// ApplyOnce applies the config like Apply, and reports the run like serve
+// does.
+func (r *RancherServer) ApplyOnce() *RunStatus {
+	return r.runOnce(r.Apply, nil)
+}
+
+// runOnce runs apply under the run lock and reports what it changed. Project clients and the
+// inventory only live for the duration of a run.
+func (r *RancherServer) runOnce(apply func() error, targets []reconcileTarget) *RunStatus {
+	r.ResetChanges()
+	r.inventory.Reset()
+	defer r.projectClients.Close()
+
+	status := &RunStatus{
+		Started: time.Now(),
+	}
+	for _, target := range targets {
+		status.Targets = append(status.Targets, target.String())
+	}
+	err := r.withLock(func() error {
+		return r.applyWithBackup(apply)
+	})
+	status.Finished = time.Now()
+
+	status.Success = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Changes = r.Changes()
+	status.DriftCount = len(status.Changes)
+	metrics.observeRun(status)
+
+	return status
+}
+
+func (d *daemon) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, req *http.Request) {
+	d.Lock()
+	status := d.lastRun
+	d.Unlock()
+
+	if status == nil {
+		http.Error(w, "No run has finished yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// watchFile signals changed whenever the modification time or size of path
+// changes. Editors and Kubernetes config maps replace the file rather than
+// write to it, so the directory of path is watched and path checked on every
+// change there. Where the directory can not be watched, e.g. when inotify is
+// out of watches, path is polled every configPollInterval instead.
+func watchFile(path string, changed chan<- bool) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	check := func() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			return
+		}
+
+		modTime, size = info.ModTime(), info.Size()
+		changed <- true
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		logrus.Warnf("Could not watch %s, polling it every %s instead: %s", path, configPollInterval, err)
+		for {
+			time.Sleep(configPollInterval)
+			check()
+		}
+	}
+	defer watcher.Close()
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-watcher.Events:
+			if settled == nil {
+				settled = time.After(configSettleDelay)
+			}
+		case err := <-watcher.Errors:
+			logrus.Warnf("Error watching %s: %s", path, err)
+		case <-settled:
+			settled = nil
+			check()
+		}
+	}
+}
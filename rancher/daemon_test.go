@@ -0,0 +1,103 @@
+package rancher
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func (d *daemon) last() *RunStatus {
+	d.Lock()
+	defer d.Unlock()
+	return d.lastRun
+}
+
+// waitForRun waits until the daemon records a run other than previous.
+func waitForRun(t *testing.T, d *daemon, previous *RunStatus) *RunStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if status := d.last(); status != nil && status != previous {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No run after %v", previous)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeIgnoresOwnChanges(t *testing.T) {
+	defer func(delay time.Duration) { eventSettleDelay = delay }(eventSettleDelay)
+	eventSettleDelay = 10 * time.Millisecond
+
+	config := registryConfig()
+	config.LdapConfig = &client.Ldapconfig{Server: "ldap.example.com", Enabled: true}
+	s := newTestServer(t, config)
+	defer s.Close()
+
+	d := &daemon{server: s.RancherServer, configFile: "config.yml"}
+	stop, done := make(chan error), make(chan error)
+	go func() { done <- d.loop(time.Hour, true, stop) }()
+	defer func() {
+		stop <- errors.New("stopped")
+		<-done
+	}()
+
+	first := waitForRun(t, d, nil)
+	if !first.Success {
+		t.Fatalf("Run failed: %s", first.Error)
+	}
+	for s.fake.Subscribers() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	registries, _ := s.registries()
+	s.fake.Update("registry", registries[0].Id, map[string]interface{}{"description": "by hand"})
+	changed := waitForRun(t, d, first)
+	if len(changed.Targets) != 1 || changed.Targets[0] != "registries:dev" {
+		t.Fatalf("Expected a run of registries:dev, got %v", changed.Targets)
+	}
+
+	// That run wrote the lock, which must not start another one.
+	time.Sleep(300 * time.Millisecond)
+	if status := d.last(); status != changed {
+		t.Fatalf("Idle server triggered a run of %v", status.Targets)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	writeFile(t, path, "projects: {}\n")
+	changed := make(chan bool)
+	go watchFile(path, changed)
+	time.Sleep(100 * time.Millisecond)
+
+	writeFile(t, filepath.Join(dir, "other.yml"), "other\n")
+	select {
+	case <-changed:
+		t.Fatalf("Change of another file reported")
+	case <-time.After(2 * configSettleDelay):
+	}
+
+	// Saved the way editors do, by renaming a new file over the old one.
+	writeFile(t, path+".tmp", "projects:\n  dev:\n    name: dev\n")
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Change not reported")
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 func (r *RancherServer) GetEnvironmentRegistrationCommand(projectName string) (string, error) {
 	var cmd string
-	project, err := getProjectByName(projectName, r.client)
+	project, err := r.getProjectByName(projectName)
 	if err != nil {
 		return cmd, err
 	}
@@ -0,0 +1,295 @@
+package rancher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/rancher/go-rancher/client"
+)
+
+var (
+	// Events arriving within this window are reconciled together.
+	eventSettleDelay    = 2 * time.Second
+	eventReconnectDelay = 5 * time.Second
+)
+
+// ownSettings are the settings rbs writes itself during a run. Their change
+// events are its own doing, reconciling them would start the next run, and
+// that one the next.
+var ownSettings = map[string]bool{
+	lockSettingName: true,
+}
+
+type resourceChangeEvent struct {
+	Name         string `json:"name"`
+	ResourceType string `json:"resourceType"`
+	ResourceId   string `json:"resourceId"`
+	Data         struct {
+		Resource map[string]interface{} `json:"resource"`
+	} `json:"data"`
+
+	// project is the name of the project whose subscription delivered the
+	// event, empty for the global one.
+	project string
+}
+
+// reconcileTarget is the part of the config a change event asks to
+// reconcile.
+type reconcileTarget struct {
+	kind    string
+	project string
+}
+
+// nodeKind is the kind of the graph nodes doing the same work as the
+// target.
+func (t reconcileTarget) nodeKind() string {
+	if t.kind == "projectmembers" {
+		return "members"
+	}
+	return t.kind
+}
+
+func (t reconcileTarget) String() string {
+	if t.project == "" {
+		return t.kind
+	}
+	return t.kind + ":" + t.project
+}
+
+// eventSubscriptions keeps one resource.change subscription open for the
+// server and one per managed project, which is where project members,
+// registries and credentials change.
+type eventSubscriptions struct {
+	sync.Mutex
+	client *client.RancherClient
+	events chan resourceChangeEvent
+	stops  map[string]chan bool
+}
+
+func newEventSubscriptions(rClient *client.RancherClient) *eventSubscriptions {
+	return &eventSubscriptions{
+		client: rClient,
+		events: make(chan resourceChangeEvent, 100),
+		stops:  map[string]chan bool{},
+	}
+}
+
+// Sync subscribes to the server and to the given projects, keyed by name,
+// and drops the subscriptions of projects no longer given.
+func (s *eventSubscriptions) Sync(projects map[string]*client.Project) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.stops[""]; !ok {
+		s.start("", s.client.Opts.Url)
+	}
+
+	for name, stop := range s.stops {
+		if _, ok := projects[name]; !ok && name != "" {
+			close(stop)
+			delete(s.stops, name)
+		}
+	}
+
+	for name, project := range projects {
+		if _, ok := s.stops[name]; !ok {
+			s.start(name, s.client.Opts.Url+"/projects/"+project.Id)
+		}
+	}
+}
+
+// Close drops all subscriptions.
+func (s *eventSubscriptions) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	for name, stop := range s.stops {
+		close(stop)
+		delete(s.stops, name)
+	}
+}
+
+func (s *eventSubscriptions) start(project string, baseURL string) {
+	url, err := subscribeURL(baseURL)
+	if err != nil {
+		logrus.Errorf("Can not subscribe to events: %s", err)
+		return
+	}
+
+	stop := make(chan bool)
+	s.stops[project] = stop
+	go subscribeEvents(s.client, url, project, s.events, stop)
+}
+
+func subscribeURL(baseURL string) (string, error) {
+	switch {
+	case strings.HasPrefix(baseURL, "http://"):
+		baseURL = "ws://" + strings.TrimPrefix(baseURL, "http://")
+	case strings.HasPrefix(baseURL, "https://"):
+		baseURL = "wss://" + strings.TrimPrefix(baseURL, "https://")
+	default:
+		return "", fmt.Errorf("Unsupported server url: %s", baseURL)
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/subscribe?eventNames=resource.change", nil
+}
+
+// subscribeEvents delivers the resource.change events of url until stop is
+// closed, reconnecting whenever the connection drops.
+func subscribeEvents(rClient *client.RancherClient, url string, project string, events chan<- resourceChangeEvent, stop <-chan bool) {
+	auth := base64.StdEncoding.EncodeToString([]byte(rClient.Opts.AccessKey + ":" + rClient.Opts.SecretKey))
+	headers := map[string][]string{
+		"Authorization": {"Basic " + auth},
+	}
+
+	for {
+		conn, _, err := rClient.Websocket(url, headers)
+		if err != nil {
+			logrus.Warnf("Could not subscribe to events at %s: %s", url, err)
+		} else {
+			logrus.Debugf("Subscribed to events at: %s", url)
+
+			done := make(chan bool)
+			go func() {
+				select {
+				case <-stop:
+				case <-done:
+				}
+				conn.Close()
+			}()
+
+			err := readEvents(conn, project, events)
+			close(done)
+			select {
+			case <-stop:
+				return
+			default:
+				logrus.Warnf("Lost event subscription at %s: %s", url, err)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(eventReconnectDelay):
+		}
+	}
+}
+
+func readEvents(conn *websocket.Conn, project string, events chan<- resourceChangeEvent) error {
+	for {
+		event := resourceChangeEvent{}
+		if err := conn.ReadJSON(&event); err != nil {
+			return err
+		}
+		if event.Name != "resource.change" {
+			continue
+		}
+
+		event.project = project
+		events <- event
+	}
+}
+
+// eventTarget maps a change event to the part of the config it affects.
+// Events for resources rbs does not manage are ignored.
+func (r *RancherServer) eventTarget(event resourceChangeEvent) (reconcileTarget, bool) {
+	switch event.ResourceType {
+	case "setting":
+		// Settings are kept under their name, which change events of the
+		// server carry as the resource id and not always in the resource.
+		if name, _ := event.Data.Resource["name"].(string); ownSettings[name] || ownSettings[event.ResourceId] {
+			return reconcileTarget{}, false
+		}
+		return reconcileTarget{kind: "auth"}, r.config.LdapConfig != nil
+	case "ldapconfig":
+		return reconcileTarget{kind: "auth"}, r.config.LdapConfig != nil
+	case "project":
+		// A project renamed on the server is still found through the state.
+		if project, ok := r.config.Projects[r.state.key("project", event.ResourceId)]; ok {
+			return reconcileTarget{kind: "project", project: project.Name}, true
+		}
+		name, _ := event.Data.Resource["name"].(string)
+		key, _ := r.getConfigProject(name)
+		return reconcileTarget{kind: "project", project: name}, key != ""
+	case "projectMember":
+		_, ok := r.config.Memberships[event.project]
+		return reconcileTarget{kind: "projectmembers", project: event.project}, ok
+	case "registry", "registryCredential":
+		_, ok := r.config.Registries[event.project]
+		return reconcileTarget{kind: "registries", project: event.project}, ok
+	}
+	return reconcileTarget{}, false
+}
+
+// reconcile configures only the parts of the config given by targets. They
+// run as the graph nodes doing the same work, in the order of the graph.
+func (r *RancherServer) reconcile(targets []reconcileTarget) error {
+	nodes := r.filter.filterGraph(r.planGraph())
+	selected := map[string]bool{}
+	for _, target := range targets {
+		logrus.Infof("Reconciling: %s", target)
+		for _, node := range nodes {
+			if node.kind == target.nodeKind() && node.project == target.project {
+				selected[node.name] = true
+			}
+		}
+	}
+	return r.runGraph(selectNodes(nodes, selected))
+}
+
+// eventProjects returns the existing projects with members or registries in
+// the config, which are the ones worth a subscription.
+func (r *RancherServer) eventProjects() (map[string]*client.Project, error) {
+	names := map[string]bool{}
+	for name := range r.config.Memberships {
+		names[name] = true
+	}
+	for name := range r.config.Registries {
+		names[name] = true
+	}
+
+	projects := map[string]*client.Project{}
+	for name := range names {
+		project, err := r.getProjectByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if project.Id != "" {
+			projects[name] = project
+		}
+	}
+	return projects, nil
+}
+
+// getConfigProject returns the config key and project named name.
+func (r *RancherServer) getConfigProject(name string) (string, *Project) {
+	for key, project := range r.config.Projects {
+		if project.Name == name {
+			return key, project
+		}
+	}
+	return "", nil
+}
+
+type targetsByName []reconcileTarget
+
+func (t targetsByName) Len() int           { return len(t) }
+func (t targetsByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t targetsByName) Less(i, j int) bool { return t[i].String() < t[j].String() }
+
+// sortedTargets orders targets by name, so runs report them the same way
+// every time.
+func sortedTargets(pending map[reconcileTarget]bool) []reconcileTarget {
+	targets := targetsByName{}
+	for target := range pending {
+		targets = append(targets, target)
+	}
+	sort.Sort(targets)
+	return targets
+}
@@ -0,0 +1,175 @@
+package rancher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestEventTarget(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	s.config.Memberships = map[string]map[string]*client.Identity{"dev": {}}
+
+	for _, test := range []struct {
+		event  resourceChangeEvent
+		target string
+		ok     bool
+	}{
+		{resourceChangeEvent{ResourceType: "registry", project: "dev"}, "registries:dev", true},
+		{resourceChangeEvent{ResourceType: "registryCredential", project: "qa"}, "registries:qa", false},
+		{resourceChangeEvent{ResourceType: "projectMember", project: "dev"}, "projectmembers:dev", true},
+		{resourceChangeEvent{ResourceType: "ldapconfig"}, "auth", false},
+		{resourceChangeEvent{ResourceType: "container"}, "", false},
+	} {
+		target, ok := s.eventTarget(test.event)
+		if ok != test.ok || (ok && target.String() != test.target) {
+			t.Errorf("Expected %s of a %s event to give %s, %v, got %s, %v", test.event.project, test.event.ResourceType, test.target, test.ok, target, ok)
+		}
+	}
+
+	s.config.LdapConfig = &client.Ldapconfig{Server: "ldap.example.com"}
+	for name, expected := range map[string]bool{"api.security.enabled": true, lockSettingName: false} {
+		setting := resourceChangeEvent{ResourceType: "setting"}
+		setting.Data.Resource = map[string]interface{}{"name": name}
+		if target, ok := s.eventTarget(setting); ok != expected || (ok && target.String() != "auth") {
+			t.Errorf("Expected the setting %s to give auth, %v, got %s, %v", name, expected, target, ok)
+		}
+	}
+	if target, ok := s.eventTarget(resourceChangeEvent{ResourceType: "setting", ResourceId: lockSettingName}); ok {
+		t.Errorf("Expected the lock setting by id to be ignored, got %s", target)
+	}
+
+	project := resourceChangeEvent{ResourceType: "project"}
+	project.Data.Resource = map[string]interface{}{"name": "dev"}
+	if target, ok := s.eventTarget(project); !ok || target.String() != "project:dev" {
+		t.Errorf("Expected the project dev, got %s, %v", target, ok)
+	}
+}
+
+func TestReconcileFollowsGraph(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+
+	targets := []reconcileTarget{{kind: "registries", project: "dev"}, {kind: "project", project: "dev"}}
+	if err := s.reconcile(targets); err != nil {
+		t.Fatal(err)
+	}
+	if projects := s.projects(); len(projects) != 1 || projects[0].Name != "dev" {
+		t.Fatalf("Expected the project dev, got %v", projects)
+	}
+	if registries, _ := s.registries(); len(registries) != 1 {
+		t.Fatalf("Expected the registry of dev, got %v", registries)
+	}
+}
+
+func TestEventSubscriptions(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	s.apply(t)
+
+	projects, err := s.eventProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriptions := newEventSubscriptions(s.client)
+	defer subscriptions.Close()
+	subscriptions.Sync(projects)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.fake.Subscribers() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 subscriptions, got %d", s.fake.Subscribers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	registries, _ := s.registries()
+	s.fake.Update("registry", registries[0].Id, map[string]interface{}{"state": "inactive"})
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case event := <-subscriptions.events:
+			if event.ResourceType != "registry" || event.ResourceId != registries[0].Id {
+				t.Fatalf("Unexpected event: %#v", event)
+			}
+			seen[event.project] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the event from both subscriptions, got %v", seen)
+		}
+	}
+	if !seen["dev"] || !seen[""] {
+		t.Fatalf("Expected the event from the server and dev, got %v", seen)
+	}
+}
+
+// newEventStream starts a websocket stand-in that sends events to every
+// client logging in as ci, then hangs up.
+func newEventStream(events ...interface{}) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "ci" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, event := range events {
+			conn.WriteJSON(event)
+		}
+	}))
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	stream := newEventStream(
+		map[string]interface{}{"name": "ping"},
+		map[string]interface{}{"name": "resource.change", "resourceType": "registry", "resourceId": "1sp5"},
+	)
+	defer stream.Close()
+
+	rClient := &client.RancherClient{}
+	rClient.Opts = &client.ClientOpts{AccessKey: "ci", SecretKey: "s3cret"}
+	events := make(chan resourceChangeEvent, 10)
+	stop := make(chan bool)
+	defer close(stop)
+	go subscribeEvents(rClient, "ws"+strings.TrimPrefix(stream.URL, "http"), "dev", events, stop)
+
+	select {
+	case event := <-events:
+		if event.ResourceType != "registry" || event.ResourceId != "1sp5" || event.project != "dev" {
+			t.Fatalf("Unexpected event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event delivered")
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("Only resource.change events should be delivered, got %#v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeURL(t *testing.T) {
+	for base, expected := range map[string]string{
+		"http://rancher:8080/v1":          "ws://rancher:8080/v1/subscribe?eventNames=resource.change",
+		"https://rancher/v1/projects/1a5": "wss://rancher/v1/projects/1a5/subscribe?eventNames=resource.change",
+	} {
+		if url, err := subscribeURL(base); err != nil || url != expected {
+			t.Errorf("Expected %s for %s, got %s, %v", expected, base, url, err)
+		}
+	}
+
+	if _, err := subscribeURL("rancher:8080"); err == nil {
+		t.Errorf("Expected an url without scheme to be refused")
+	}
+}
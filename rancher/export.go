@@ -0,0 +1,142 @@
+package rancher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/rancher/go-rancher/client"
+)
+
+// ExportStacks writes the compose files of every stack in the configured
+// projects to <outputDir>/<project>/<stack>/. With writeConfig set, a
+// stacks.yml referencing those files in the stacks: config format is written
+// to outputDir as well.
+func (r *RancherServer) ExportStacks(outputDir string, writeConfig bool) error {
+	projectNames := []string{}
+	for _, project := range r.config.Projects {
+		if project.State != "Purged" {
+			projectNames = append(projectNames, project.Name)
+		}
+	}
+	sort.Strings(projectNames)
+
+	exported := map[string]map[string]*Stack{}
+	for _, projectName := range projectNames {
+		project, err := r.getProjectByName(projectName)
+		if err != nil {
+			return err
+		}
+		if project.Id == "" {
+			r.log.Warnf("Project %s does not exist, skipping", projectName)
+			continue
+		}
+
+		projectClient, err := r.projectClients.Get(project, r.log)
+		if err != nil {
+			return err
+		}
+
+		stacks, err := projectClient.Environment.List(&client.ListOpts{})
+		if err == nil {
+			err = followPages(projectClient, stacks)
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, stack := range stacks.Data {
+			if stack.State == "removed" || stack.State == "purged" || stack.State == "removing" {
+				continue
+			}
+
+			stackConfig, err := exportStack(projectClient, &stacks.Data[i], filepath.Join(outputDir, projectName, stack.Name), r.log)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := exported[projectName]; !ok {
+				exported[projectName] = map[string]*Stack{}
+			}
+			exported[projectName][stack.Name] = stackConfig
+		}
+	}
+
+	if !writeConfig {
+		return nil
+	}
+
+	configFile := filepath.Join(outputDir, "stacks.yml")
+	r.log.Infof("Writing stacks config: %s", configFile)
+	file, err := os.Create(configFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return candiedyaml.NewEncoder(file).Encode(map[string]interface{}{
+		"stacks": exported,
+	})
+}
+
+func exportStack(prjClient *client.RancherClient, stack *client.Environment, stackDir string, log *logrus.Entry) (*Stack, error) {
+	log.Infof("Exporting stack: %s", stack.Name)
+	composeConfig, err := prjClient.Environment.ActionExportconfig(stack, &client.ComposeConfigInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(stackDir, 0755); err != nil {
+		return nil, err
+	}
+
+	dockerComposeFile := filepath.Join(stackDir, "docker-compose.yml")
+	if err := ioutil.WriteFile(dockerComposeFile, []byte(composeConfig.DockerComposeConfig), 0644); err != nil {
+		return nil, fmt.Errorf("Could not write %s: %s", dockerComposeFile, err)
+	}
+
+	rancherComposeFile := filepath.Join(stackDir, "rancher-compose.yml")
+	if err := ioutil.WriteFile(rancherComposeFile, []byte(composeConfig.RancherComposeConfig), 0644); err != nil {
+		return nil, fmt.Errorf("Could not write %s: %s", rancherComposeFile, err)
+	}
+
+	environment := map[string]string{}
+	redacted := []string{}
+	for key, value := range stack.Environment {
+		if isSecretAnswer(key) {
+			environment[key] = "env:" + key
+			redacted = append(redacted, key)
+			continue
+		}
+		environment[key] = fmt.Sprintf("%v", value)
+	}
+	if len(redacted) > 0 {
+		sort.Strings(redacted)
+		log.Warnf("Stack %s: answers %s are secret, the stacks config reads them from the environment", stack.Name, strings.Join(redacted, ", "))
+	}
+
+	return &Stack{
+		DockerCompose:  "file:" + dockerComposeFile,
+		RancherCompose: "file:" + rancherComposeFile,
+		Environment:    environment,
+	}, nil
+}
+
+// secretAnswerWords mark the answers of a stack that hold secrets by their
+// name, like DB_PASSWORD or AWS_SECRET_KEY.
+var secretAnswerWords = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "PRIVATE"}
+
+func isSecretAnswer(name string) bool {
+	name = strings.ToUpper(name)
+	for _, word := range secretAnswerWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudnautique/rbs-sandbox/rancher/ranchertest"
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestExportStacksLeavesOutSecrets(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+	})
+	defer s.Close()
+	s.apply(t)
+
+	s.fake.HandleAction("environment", "exportconfig", func(_ *ranchertest.Server, _ map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{
+			"type":                 "composeConfig",
+			"dockerComposeConfig":  "web:\n  image: nginx\n",
+			"rancherComposeConfig": "web:\n  scale: 1\n",
+		}, nil
+	})
+	s.fake.Add("environment", &client.Environment{
+		Name:      "backup",
+		AccountId: s.projects()[0].Id,
+		Environment: map[string]interface{}{
+			"AWS_REGION":     "eu-west-1",
+			"AWS_SECRET_KEY": "hunter2",
+		},
+	})
+
+	if err := s.ExportStacks(s.dir, true); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, "stacks.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := string(content)
+	if strings.Contains(config, "hunter2") || !strings.Contains(config, "env:AWS_SECRET_KEY") || !strings.Contains(config, "eu-west-1") {
+		t.Fatalf("Unexpected stacks config:\n%s", config)
+	}
+}
@@ -0,0 +1,244 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filter narrows a run down to part of the config. Empty fields select
+// everything.
+type Filter struct {
+	// Kinds of steps to run, e.g. accounts or registries.
+	Kinds []string
+	// Projects whose steps run. Server wide steps, like auth and accounts,
+	// are left out when projects are given.
+	Projects []string
+	// Resources as kind:name, where name may be a glob, e.g.
+	// registry:*.example.com. Only steps holding such resources run, and
+	// within them only the matching resources are touched.
+	Resources []string
+}
+
+// stepKinds maps the step kinds a filter may name to the prefix of the
+// graph nodes running them.
+var stepKinds = map[string]string{
+	"auth":         "auth",
+	"ldap":         "auth",
+	"account":      "accounts",
+	"accounts":     "accounts",
+	"project":      "project",
+	"projects":     "project",
+	"environment":  "project",
+	"environments": "project",
+	"member":       "members",
+	"members":      "members",
+	"volume":       "volumes",
+	"volumes":      "volumes",
+	"registry":     "registries",
+	"registries":   "registries",
+	"prepull":      "prepull",
+	"catalog":      "catalog",
+	"stack":        "stacks",
+	"stacks":       "stacks",
+	"apikey":       "apikeys",
+	"apikeys":      "apikeys",
+}
+
+// resourceKinds maps the kinds of resources a filter may name to the
+// graph nodes configuring them.
+var resourceKinds = map[string]string{
+	"project":  "project",
+	"account":  "accounts",
+	"volume":   "volumes",
+	"registry": "registries",
+	"image":    "prepull",
+	"catalog":  "catalog",
+	"stack":    "stacks",
+	"apikey":   "apikeys",
+}
+
+type resourceFilter struct {
+	kind    string
+	pattern string
+}
+
+// nodeFilter is a parsed Filter.
+type nodeFilter struct {
+	kinds     map[string]bool
+	projects  map[string]bool
+	resources []resourceFilter
+}
+
+func newNodeFilter(filter *Filter) (*nodeFilter, error) {
+	f := &nodeFilter{
+		kinds:    map[string]bool{},
+		projects: map[string]bool{},
+	}
+	if filter == nil {
+		return f, nil
+	}
+
+	for _, kind := range filter.Kinds {
+		nodeKind, ok := stepKinds[strings.ToLower(kind)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown kind: %s", kind)
+		}
+		f.kinds[nodeKind] = true
+	}
+
+	for _, project := range filter.Projects {
+		f.projects[project] = true
+	}
+
+	for _, resource := range filter.Resources {
+		parts := strings.SplitN(resource, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Resource must be given as kind:name, got: %s", resource)
+		}
+		kind := strings.ToLower(parts[0])
+		if _, ok := resourceKinds[kind]; !ok {
+			return nil, fmt.Errorf("Unknown resource kind: %s", parts[0])
+		}
+		if _, err := matchesAny([]string{parts[1]}, ""); err != nil {
+			return nil, err
+		}
+		f.resources = append(f.resources, resourceFilter{kind, parts[1]})
+	}
+
+	return f, nil
+}
+
+func (f *nodeFilter) empty() bool {
+	return len(f.kinds) == 0 && len(f.projects) == 0 && len(f.resources) == 0
+}
+
+// selectsNode tells whether a graph node of kind for project runs.
+func (f *nodeFilter) selectsNode(kind string, project string) bool {
+	if len(f.kinds) > 0 && !f.kinds[kind] {
+		return false
+	}
+	if len(f.projects) > 0 && !f.projects[project] {
+		return false
+	}
+	if len(f.resources) == 0 {
+		return true
+	}
+
+	for _, resource := range f.resources {
+		if resourceKinds[resource.kind] != kind {
+			continue
+		}
+		if kind != "project" {
+			return true
+		}
+		if matched, _ := matchesAny([]string{resource.pattern}, project); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// selectsResource tells whether a resource of kind, see resourceKinds, is
+// touched by the steps that run.
+func (f *nodeFilter) selectsResource(kind string, name string) bool {
+	filtered := false
+	for _, resource := range f.resources {
+		if resource.kind != kind {
+			continue
+		}
+		filtered = true
+		if matched, _ := matchesAny([]string{resource.pattern}, name); matched {
+			return true
+		}
+	}
+	return !filtered
+}
+
+// filterGraph drops the nodes the filter does not select. The nodes a
+// selected node depends on in its own project are kept too, server wide
+// ones only when selected themselves.
+func (f *nodeFilter) filterGraph(nodes []*graphNode) []*graphNode {
+	if f.empty() {
+		return nodes
+	}
+
+	byName := map[string]*graphNode{}
+	for _, node := range nodes {
+		byName[node.name] = node
+	}
+
+	selected := map[string]bool{}
+	var pull func(node *graphNode)
+	pull = func(node *graphNode) {
+		selected[node.name] = true
+		for _, dep := range node.deps {
+			if depNode := byName[dep]; node.project != "" && depNode.project == node.project && !selected[dep] {
+				pull(depNode)
+			}
+		}
+	}
+	for _, node := range nodes {
+		if f.selectsNode(node.kind, node.project) {
+			pull(node)
+		}
+	}
+
+	return selectNodes(nodes, selected)
+}
+
+// selectNodes returns the selected nodes in their order, depending only on
+// selected nodes.
+func selectNodes(nodes []*graphNode, selected map[string]bool) []*graphNode {
+	filtered := []*graphNode{}
+	for _, node := range nodes {
+		if !selected[node.name] {
+			continue
+		}
+
+		deps := []string{}
+		for _, dep := range node.deps {
+			if selected[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		filtered = append(filtered, &graphNode{
+			name:    node.name,
+			kind:    node.kind,
+			project: node.project,
+			deps:    deps,
+			run:     node.run,
+		})
+	}
+	return filtered
+}
+
+func splitNodeName(name string) (string, string) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// SetFilter limits the runs of r to part of the config.
+func (r *RancherServer) SetFilter(filter *Filter) error {
+	f, err := newNodeFilter(filter)
+	if err != nil {
+		return err
+	}
+	r.filter = f
+	return nil
+}
+
+// selected tells whether the resource kind:name is part of the run.
+func (r *RancherServer) selected(kind string, name string) bool {
+	return r.filter.selectsResource(kind, name)
+}
+
+func nodeNames(nodes []*graphNode) string {
+	names := []string{}
+	for _, node := range nodes {
+		names = append(names, node.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,88 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func filteredNodes(t *testing.T, filter *Filter) string {
+	r := &RancherServer{config: graphConfig()}
+	if err := r.SetFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+	return nodeNames(r.filter.filterGraph(r.planGraph()))
+}
+
+func TestPlanGraphKeysProjects(t *testing.T) {
+	config := graphConfig()
+	config.Projects["renamed"] = &Project{Project: client.Project{Name: "dev"}}
+	r := &RancherServer{config: config}
+	if err := r.SetFilter(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := r.filter.filterGraph(r.planGraph())
+	expected := "auth, accounts, project:dev, project:renamed, project:prod, members:prod, registries:dev, registries:prod, apikeys"
+	if names := nodeNames(nodes); names != expected {
+		t.Fatalf("Expected %s, got %s", expected, names)
+	}
+	for _, node := range nodes {
+		if node.name == "registries:dev" && strings.Join(node.deps, ", ") != "project:dev, project:renamed" {
+			t.Fatalf("Expected registries:dev to follow both dev projects, got %v", node.deps)
+		}
+	}
+
+	if err := r.SetFilter(&Filter{Projects: []string{"dev"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected = "project:dev, project:renamed, registries:dev"
+	if names := nodeNames(r.filter.filterGraph(r.planGraph())); names != expected {
+		t.Fatalf("Expected %s, got %s", expected, names)
+	}
+}
+
+func TestFilterGraph(t *testing.T) {
+	for _, test := range []struct {
+		filter   *Filter
+		expected string
+	}{
+		{&Filter{Kinds: []string{"registries"}}, "project:dev, project:prod, registries:dev, registries:prod"},
+		{&Filter{Projects: []string{"prod"}}, "project:prod, members:prod, registries:prod"},
+		{&Filter{Kinds: []string{"accounts"}}, "accounts"},
+		{&Filter{Resources: []string{"project:d*"}}, "project:dev"},
+		{&Filter{Resources: []string{"registry:*.example.com"}}, "project:dev, project:prod, registries:dev, registries:prod"},
+	} {
+		if nodes := filteredNodes(t, test.filter); nodes != test.expected {
+			t.Errorf("Expected %s for %#v, got %s", test.expected, test.filter, nodes)
+		}
+	}
+}
+
+func TestFilterRejectsUnknownKinds(t *testing.T) {
+	for _, filter := range []*Filter{
+		{Kinds: []string{"containers"}},
+		{Resources: []string{"registry"}},
+		{Resources: []string{"host:*"}},
+		{Resources: []string{"registry:["}},
+	} {
+		if _, err := newNodeFilter(filter); err == nil {
+			t.Errorf("Expected %#v to be refused", filter)
+		}
+	}
+}
+
+func TestSelectsResource(t *testing.T) {
+	f, err := newNodeFilter(&Filter{Resources: []string{"registry:*.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.selectsResource("registry", "test1.example.com") || f.selectsResource("registry", "docker.io") {
+		t.Errorf("Expected only registries of example.com to be selected")
+	}
+	if !f.selectsResource("account", "alice") {
+		t.Errorf("Expected resources of other kinds to be selected")
+	}
+}
@@ -0,0 +1,210 @@
+package rancher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-incubator/candiedyaml"
+)
+
+// Fleet is an inventory of Rancher servers configured from shared config
+// files.
+type Fleet struct {
+	Servers map[string]*FleetServer `yaml:"servers"`
+
+	// dir is where relative paths in the inventory start from.
+	dir string
+}
+
+// FleetServer is one server of a fleet.
+type FleetServer struct {
+	// URL of the server, it replaces the server url of the configs.
+	URL string `yaml:"url"`
+
+	// KeyFile holds the admin keys of the server, like --key-file.
+	KeyFile string `yaml:"key_file"`
+
+	// StateFile is the state file of the server, like --state-file.
+	StateFile string `yaml:"state_file"`
+
+	// Configs are read in order, each one overlaying the ones before it.
+	Configs []string `yaml:"configs"`
+}
+
+// FleetResult is the outcome of the run against one server of a fleet.
+type FleetResult struct {
+	Server string
+	Status *RunStatus
+}
+
+// LoadFleet reads the inventory in path.
+func LoadFleet(path string) (*Fleet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("File does not exist: %s\n%s", path, err)
+	}
+	defer file.Close()
+
+	fleet := &Fleet{dir: filepath.Dir(path)}
+	decoder := candiedyaml.NewDecoder(file)
+	if err = decoder.Decode(fleet); err != nil {
+		return nil, fmt.Errorf("Could not parse inventory: %s\n%s", path, err)
+	}
+
+	for name, server := range fleet.Servers {
+		if server == nil || server.URL == "" {
+			return nil, fmt.Errorf("No url for server %s in inventory: %s", name, path)
+		}
+		if len(server.Configs) == 0 {
+			return nil, fmt.Errorf("No configs for server %s in inventory: %s", name, path)
+		}
+		if server.KeyFile == "" {
+			return nil, fmt.Errorf("No key_file for server %s in inventory: %s", name, path)
+		}
+	}
+
+	return fleet, nil
+}
+
+// Match returns the names of the servers matching any of patterns, which
+// may be globs, in name order. No patterns match every server.
+func (f *Fleet) Match(patterns []string) ([]string, error) {
+	names := []string{}
+	for name := range f.Servers {
+		if len(patterns) > 0 {
+			matched, err := matchesAny(patterns, name)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No servers match: %s", strings.Join(patterns, ", "))
+	}
+	return names, nil
+}
+
+func (f *Fleet) path(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(f.dir, path)
+}
+
+// connect loads the config of the server called name and connects to it.
+// Its log lines are tagged with the server name.
+func (f *Fleet) connect(name string) (*RancherServer, error) {
+	server := f.Servers[name]
+
+	config := &RancherBootstrapConfig{}
+	for _, configFile := range server.Configs {
+		if err := decodeConfig(config, f.path(configFile)); err != nil {
+			return nil, err
+		}
+	}
+	config.Server = &RancherServerConfig{URL: server.URL}
+
+	log := logrus.WithField("server", name)
+	configFile := server.Configs[len(server.Configs)-1]
+	r, err := newRancherServer(config, configFile, f.path(server.KeyFile), log)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.StateFile != "" {
+		if err := r.SetStateFile(f.path(server.StateFile)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Apply applies the config of each of the servers called names, all at the
+// same time. setup is called on every server before its run, to pass on
+// options like the filter.
+func (f *Fleet) Apply(names []string, setup func(r *RancherServer) error) []*FleetResult {
+	results := make([]*FleetResult, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = &FleetResult{
+				Server: name,
+				Status: f.apply(name, setup),
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (f *Fleet) apply(name string, setup func(r *RancherServer) error) *RunStatus {
+	started := time.Now()
+	failed := func(err error) *RunStatus {
+		logrus.WithField("server", name).Errorf("Failed: %s", err)
+		return &RunStatus{
+			Started:  started,
+			Finished: time.Now(),
+			Error:    err.Error(),
+		}
+	}
+
+	r, err := f.connect(name)
+	if err != nil {
+		return failed(err)
+	}
+	r.CloseOnExit()
+	defer r.Close()
+
+	if err := setup(r); err != nil {
+		return failed(err)
+	}
+
+	status := r.ApplyOnce()
+	if !status.Success {
+		r.log.Errorf("Failed: %s", status.Error)
+	}
+	return status
+}
+
+// WriteFleetSummary writes a table of the results of a fleet run.
+func WriteFleetSummary(out io.Writer, results []*FleetResult) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tRESULT\tCHANGES\tDURATION\tERROR")
+	for _, result := range results {
+		status := result.Status
+		outcome := "ok"
+		if !status.Success {
+			outcome = "failed"
+		}
+		duration := roundSeconds(status.Finished.Sub(status.Started))
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", result.Server, outcome, status.DriftCount, duration, firstLine(status.Error))
+	}
+	return w.Flush()
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+// roundSeconds rounds d to the nearest second.
+func roundSeconds(d time.Duration) time.Duration {
+	return (d + time.Second/2) / time.Second * time.Second
+}
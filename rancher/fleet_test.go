@@ -0,0 +1,114 @@
+package rancher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudnautique/rbs-sandbox/rancher/ranchertest"
+	"github.com/rancher/go-rancher/client"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFleetApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	staging, prod := ranchertest.NewServer(), ranchertest.NewServer()
+	defer staging.Close()
+	defer prod.Close()
+
+	writeFile(t, filepath.Join(dir, "base.yml"), "projects:\n  app:\n    name: app\n")
+	writeFile(t, filepath.Join(dir, "prod.yml"), "projects:\n  app:\n    name: app-prod\n")
+	writeFile(t, filepath.Join(dir, "inventory.yml"), `servers:
+  staging:
+    url: `+staging.URL+`
+    key_file: staging-keys.yml
+    configs: [base.yml]
+  prod:
+    url: `+prod.URL+`
+    key_file: prod-keys.yml
+    configs: [base.yml, prod.yml]
+`)
+
+	fleet, err := LoadFleet(filepath.Join(dir, "inventory.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := fleet.Match(nil)
+	if err != nil || strings.Join(names, ",") != "prod,staging" {
+		t.Fatalf("Expected both servers, got %v, %v", names, err)
+	}
+	if _, err := fleet.Match([]string{"dev*"}); err == nil {
+		t.Fatalf("Expected no match for dev*")
+	}
+
+	results := fleet.Apply(names, func(r *RancherServer) error { return nil })
+	for _, result := range results {
+		if !result.Status.Success {
+			t.Fatalf("Run against %s failed: %s", result.Server, result.Status.Error)
+		}
+	}
+
+	for server, expected := range map[*ranchertest.Server]string{staging: "app", prod: "app-prod"} {
+		projects := []client.Project{}
+		server.List("project", &projects)
+		if len(projects) != 1 || projects[0].Name != expected {
+			t.Errorf("Expected the project %s, got %#v", expected, projects)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	WriteFleetSummary(out, results)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "prod ") {
+		t.Fatalf("Unexpected summary:\n%s", out)
+	}
+}
+
+func TestFleetApplyReportsBadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	staging, prod := ranchertest.NewServer(), ranchertest.NewServer()
+	defer staging.Close()
+	defer prod.Close()
+
+	writeFile(t, filepath.Join(dir, "base.yml"), "projects:\n  app:\n    name: app\n")
+	writeFile(t, filepath.Join(dir, "prod-keys.yml"), "access_key: [unterminated\n")
+	writeFile(t, filepath.Join(dir, "inventory.yml"), `servers:
+  staging:
+    url: `+staging.URL+`
+    key_file: staging-keys.yml
+    configs: [base.yml]
+  prod:
+    url: `+prod.URL+`
+    key_file: prod-keys.yml
+    configs: [base.yml]
+`)
+
+	fleet, err := LoadFleet(filepath.Join(dir, "inventory.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := fleet.Apply([]string{"prod", "staging"}, func(r *RancherServer) error { return nil })
+	if results[0].Status.Success || !strings.Contains(results[0].Status.Error, "Could not parse keys") {
+		t.Fatalf("Expected prod to fail on its keys, got %#v", results[0].Status)
+	}
+	if !results[1].Status.Success {
+		t.Fatalf("Run against staging failed: %s", results[1].Status.Error)
+	}
+}
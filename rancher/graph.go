@@ -0,0 +1,322 @@
+package rancher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// graphNode is one piece of reconcile work, for the server or for one
+// project. It only runs once the nodes it depends on succeeded.
+type graphNode struct {
+	// name is unique in the graph, kind and project are what filters and
+	// change events select nodes by. Project nodes are named by their key
+	// in the config, as two keys may hold the same project name while one
+	// of them is being renamed, all others by the project name.
+	name    string
+	kind    string
+	project string
+
+	deps []string
+	run  func(r *RancherServer) error
+}
+
+type graphPlan struct {
+	nodes []*graphNode
+	names map[string]bool
+
+	// projects holds the names of the project nodes by project name.
+	projects map[string][]string
+}
+
+func (p *graphPlan) add(name string, run func(r *RancherServer) error, deps ...string) *graphNode {
+	kind, project := splitNodeName(name)
+	node := &graphNode{
+		name:    name,
+		kind:    kind,
+		project: project,
+		run:     run,
+	}
+	for _, dep := range deps {
+		if p.names[dep] {
+			node.deps = append(node.deps, dep)
+		}
+	}
+
+	p.nodes = append(p.nodes, node)
+	p.names[name] = true
+	return node
+}
+
+// projectNodes returns the names of the nodes configuring the project
+// called name.
+func (p *graphPlan) projectNodes(name string) []string {
+	return p.projects[name]
+}
+
+// projectKeys sorts config keys by the name of their project, then by key.
+type projectKeys struct {
+	keys     []string
+	projects map[string]*Project
+}
+
+func (p projectKeys) Len() int      { return len(p.keys) }
+func (p projectKeys) Swap(i, j int) { p.keys[i], p.keys[j] = p.keys[j], p.keys[i] }
+func (p projectKeys) Less(i, j int) bool {
+	a, b := p.projects[p.keys[i]].Name, p.projects[p.keys[j]].Name
+	if a != b {
+		return a < b
+	}
+	return p.keys[i] < p.keys[j]
+}
+
+// planGraph lays out the reconcile work: auth before accounts, projects
+// before what lives in them, registries before the pulls and stacks that
+// need their credentials. Nodes are added step by step and project by
+// project in name order, so every node comes after its dependencies and the
+// order is the same on every run.
+func (r *RancherServer) planGraph() []*graphNode {
+	plan := &graphPlan{names: map[string]bool{}, projects: map[string][]string{}}
+
+	plan.add("auth", func(r *RancherServer) error {
+		return r.ConfigureAuthBackend()
+	})
+	plan.add("accounts", func(r *RancherServer) error {
+		return r.ConfigureAccounts()
+	}, "auth")
+
+	keys := projectKeys{projects: r.config.Projects}
+	for key := range r.config.Projects {
+		keys.keys = append(keys.keys, key)
+	}
+	sort.Sort(keys)
+	projectNodes := []string{"accounts"}
+	for _, key := range keys.keys {
+		key, project := key, r.config.Projects[key]
+		node := plan.add("project:"+key, func(r *RancherServer) error {
+			return r.configureEnvironment(key, project)
+		}, "auth")
+		node.project = project.Name
+		plan.projects[project.Name] = append(plan.projects[project.Name], node.name)
+		projectNodes = append(projectNodes, node.name)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Memberships) {
+		name := name
+		members := r.config.Memberships[name]
+		plan.add("members:"+name, func(r *RancherServer) error {
+			return r.configureEnvironmentAccess(name, members)
+		}, append(plan.projectNodes(name), "accounts")...)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Volumes) {
+		name := name
+		volumes := r.config.Volumes[name]
+		plan.add("volumes:"+name, func(r *RancherServer) error {
+			return r.configureProjectVolumes(name, volumes)
+		}, plan.projectNodes(name)...)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Registries) {
+		name := name
+		registries := r.config.Registries[name]
+		plan.add("registries:"+name, func(r *RancherServer) error {
+			return r.configureProjectRegistries(name, registries)
+		}, plan.projectNodes(name)...)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Prepull) {
+		name := name
+		pullTasks := r.config.Prepull[name]
+		plan.add("prepull:"+name, func(r *RancherServer) error {
+			return r.configureProjectPrepull(name, pullTasks)
+		}, append(plan.projectNodes(name), "registries:"+name)...)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Catalog) {
+		name := name
+		stacks := r.config.Catalog[name]
+		plan.add("catalog:"+name, func(r *RancherServer) error {
+			return r.configureProjectCatalog(name, stacks)
+		}, append(plan.projectNodes(name), "volumes:"+name, "registries:"+name, "prepull:"+name)...)
+	}
+
+	for _, name := range sortedProjectNames(r.config.Stacks) {
+		name := name
+		stacks := r.config.Stacks[name]
+		plan.add("stacks:"+name, func(r *RancherServer) error {
+			return r.configureProjectStacks(name, stacks)
+		}, append(plan.projectNodes(name), "volumes:"+name, "registries:"+name, "prepull:"+name)...)
+	}
+
+	plan.add("apikeys", func(r *RancherServer) error {
+		return r.ConfigureApiKeys()
+	}, projectNodes...)
+
+	return plan.nodes
+}
+
+// sortedProjectNames returns the keys of a per project config section, a
+// map keyed by project name.
+func sortedProjectNames(section interface{}) []string {
+	names := []string{}
+	for _, key := range reflect.ValueOf(section).MapKeys() {
+		names = append(names, key.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetParallelism sets how many independent nodes of the reconcile graph run
+// at the same time.
+func (r *RancherServer) SetParallelism(parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	r.parallelism = parallelism
+}
+
+// runGraph runs nodes, which must come after their dependencies, with up to
+// r.parallelism at a time. Nodes whose dependencies failed are skipped, all
+// others still run, unless the run lost its lock, after which no node starts.
+// When more than one node runs at a time, each node's log
+// lines are held back and written in node order, so the output reads the
+// same as a serial run.
+func (r *RancherServer) runGraph(nodes []*graphNode) error {
+	index := map[string]int{}
+	for i, node := range nodes {
+		for _, dep := range node.deps {
+			if j, ok := index[dep]; !ok || j >= i {
+				return fmt.Errorf("Node %s depends on %s, which does not come before it", node.name, dep)
+			}
+		}
+		index[node.name] = i
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+
+	out := logrus.StandardLogger().Out
+	buffered := r.parallelism > 1
+	outputs := make([]*bytes.Buffer, len(nodes))
+	started := make([]bool, len(nodes))
+	done := make([]bool, len(nodes))
+	errs := make([]error, len(nodes))
+	skipped := make([]bool, len(nodes))
+	results := make(chan result)
+
+	nodeServer := func(i int) *RancherServer {
+		nodeOut := out
+		if buffered {
+			outputs[i] = &bytes.Buffer{}
+			nodeOut = outputs[i]
+		}
+		return r.withLog(nodeOut, nodes[i].name)
+	}
+
+	running, finished, printed := 0, 0, 0
+	lockLost := false
+	for finished < len(nodes) {
+		for i, node := range nodes {
+			if started[i] || running >= r.parallelism {
+				continue
+			}
+
+			ready, failedDep := true, ""
+			for _, dep := range node.deps {
+				if !done[index[dep]] {
+					ready = false
+					break
+				}
+				if errs[index[dep]] != nil && failedDep == "" {
+					failedDep = dep
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			started[i] = true
+			if failedDep != "" {
+				nodeServer(i).log.Warnf("Skipping, %s failed", failedDep)
+				done[i], skipped[i] = true, true
+				errs[i] = fmt.Errorf("%s failed", failedDep)
+				finished++
+				continue
+			}
+			if r.lostLock() {
+				nodeServer(i).log.Warnf("Skipping, the run lock was lost")
+				done[i], skipped[i] = true, true
+				errs[i] = errLockLost
+				finished++
+				lockLost = true
+				continue
+			}
+
+			running++
+			go func(i int, s *RancherServer) {
+				err := nodes[i].run(s)
+				if err != nil {
+					s.log.Errorf("Failed: %s", err)
+				}
+				results <- result{i, err}
+			}(i, nodeServer(i))
+		}
+
+		for buffered && printed < len(nodes) && done[printed] {
+			outputs[printed].WriteTo(out)
+			printed++
+		}
+
+		if finished == len(nodes) {
+			break
+		}
+
+		res := <-results
+		running--
+		finished++
+		done[res.index] = true
+		errs[res.index] = res.err
+	}
+
+	for buffered && printed < len(nodes) {
+		outputs[printed].WriteTo(out)
+		printed++
+	}
+
+	if lockLost {
+		return errLockLost
+	}
+
+	failures := []string{}
+	for i, err := range errs {
+		if err != nil && !skipped[i] {
+			failures = append(failures, fmt.Sprintf("%s: %s", nodes[i].name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to configure %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// withLog returns a copy of r logging to out, with every line tagged with
+// the graph node it belongs to on top of the fields r logs with.
+func (r *RancherServer) withLog(out io.Writer, node string) *RancherServer {
+	std := logrus.StandardLogger()
+	logger := logrus.New()
+	logger.Out = out
+	logger.Formatter = std.Formatter
+	logger.Level = std.Level
+
+	nodeServer := *r
+	nodeServer.log = logrus.NewEntry(logger).WithFields(r.log.Data).WithField("resource", node)
+	return &nodeServer
+}
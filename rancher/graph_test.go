@@ -0,0 +1,79 @@
+package rancher
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func graphConfig() *RancherBootstrapConfig {
+	return &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev":  {Project: client.Project{Name: "dev"}},
+			"prod": {Project: client.Project{Name: "prod"}},
+		},
+		Registries: map[string][]client.Registry{
+			"dev":  {{ServerAddress: "registry.example.com"}},
+			"prod": {{ServerAddress: "registry.example.com"}},
+		},
+		Memberships: map[string]map[string]*client.Identity{
+			"prod": {},
+		},
+	}
+}
+
+func TestPlanGraph(t *testing.T) {
+	r := &RancherServer{config: graphConfig()}
+	names := []string{}
+	for _, node := range r.planGraph() {
+		names = append(names, node.name)
+	}
+
+	expected := "auth, accounts, project:dev, project:prod, members:prod, registries:dev, registries:prod, apikeys"
+	if joined := strings.Join(names, ", "); joined != expected {
+		t.Fatalf("Expected %s, got %s", expected, joined)
+	}
+}
+
+func TestRunGraph(t *testing.T) {
+	var lock sync.Mutex
+	ran := []string{}
+	node := func(name string, err error, deps ...string) *graphNode {
+		return &graphNode{name: name, deps: deps, run: func(r *RancherServer) error {
+			lock.Lock()
+			ran = append(ran, name)
+			lock.Unlock()
+			return err
+		}}
+	}
+
+	r := &RancherServer{parallelism: 4, log: testLog()}
+	err := r.runGraph([]*graphNode{
+		node("auth", nil),
+		node("project:dev", errors.New("boom"), "auth"),
+		node("registries:dev", nil, "project:dev"),
+		node("project:prod", nil, "auth"),
+		node("registries:prod", nil, "project:prod"),
+	})
+
+	if err == nil || err.Error() != "Failed to configure project:dev: boom" {
+		t.Fatalf("Expected project:dev to fail, got %v", err)
+	}
+	if joined := strings.Join(ran, ","); strings.Contains(joined, "registries:dev") || !strings.Contains(joined, "registries:prod") {
+		t.Fatalf("Expected the nodes after the failure to be skipped, others to run, got %s", joined)
+	}
+}
+
+func TestRunGraphChecksOrder(t *testing.T) {
+	r := &RancherServer{parallelism: 1, log: testLog()}
+	err := r.runGraph([]*graphNode{
+		{name: "registries:dev", deps: []string{"project:dev"}},
+		{name: "project:dev"},
+	})
+	if err == nil {
+		t.Fatalf("Expected a node before its dependency to be refused")
+	}
+}
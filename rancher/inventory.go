@@ -0,0 +1,141 @@
+package rancher
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+// inventory caches the collections rbs looks things up in, so each is paged
+// through once per run instead of once per lookup. Whatever a write may have
+// changed is dropped and loaded again on next use.
+type inventory struct {
+	sync.Mutex
+	client      *client.RancherClient
+	projects    *client.ProjectCollection
+	accounts    *client.AccountCollection
+	registries  map[string]*client.RegistryCollection
+	credentials map[string]*client.RegistryCredentialCollection
+}
+
+func newInventory(rClient *client.RancherClient) *inventory {
+	return &inventory{
+		client:      rClient,
+		registries:  map[string]*client.RegistryCollection{},
+		credentials: map[string]*client.RegistryCredentialCollection{},
+	}
+}
+
+func (i *inventory) Projects() (*client.ProjectCollection, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.projects == nil {
+		logrus.Debugf("Loading projects")
+		projects, err := i.client.Project.List(&client.ListOpts{})
+		if err == nil {
+			err = followPages(i.client, projects)
+		}
+		if err != nil {
+			return nil, err
+		}
+		i.projects = projects
+	}
+	return i.projects, nil
+}
+
+func (i *inventory) Accounts() (*client.AccountCollection, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.accounts == nil {
+		logrus.Debugf("Loading accounts")
+		accounts, err := i.client.Account.List(&client.ListOpts{})
+		if err == nil {
+			err = followPages(i.client, accounts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		i.accounts = accounts
+	}
+	return i.accounts, nil
+}
+
+// Registries returns the registries of project, listed with its client.
+func (i *inventory) Registries(prjClient *client.RancherClient, project *client.Project) (*client.RegistryCollection, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if _, ok := i.registries[project.Name]; !ok {
+		logrus.Debugf("Loading registries for: %s", project.Name)
+		registries := &client.RegistryCollection{}
+		if err := listLink(prjClient, project.Resource, "registries", registries); err != nil {
+			return nil, err
+		}
+		i.registries[project.Name] = registries
+	}
+	return i.registries[project.Name], nil
+}
+
+// RegistryCredentials returns the registry credentials of project, listed
+// with its client.
+func (i *inventory) RegistryCredentials(prjClient *client.RancherClient, project *client.Project) (*client.RegistryCredentialCollection, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if _, ok := i.credentials[project.Name]; !ok {
+		logrus.Debugf("Loading registry credentials for: %s", project.Name)
+		credentials := &client.RegistryCredentialCollection{}
+		if err := listLink(prjClient, project.Resource, "credentials", credentials); err != nil {
+			return nil, err
+		}
+		i.credentials[project.Name] = credentials
+	}
+	return i.credentials[project.Name], nil
+}
+
+// invalidate drops what a change of kind in project may have made stale.
+func (i *inventory) invalidate(project string, kind string) {
+	i.Lock()
+	defer i.Unlock()
+
+	switch kind {
+	case "project":
+		i.projects = nil
+	case "account":
+		i.accounts = nil
+	case "registry", "registrycredential":
+		delete(i.registries, project)
+		delete(i.credentials, project)
+	}
+}
+
+// Reset drops everything, changes made by others since are picked up.
+func (i *inventory) Reset() {
+	i.Lock()
+	defer i.Unlock()
+
+	i.projects = nil
+	i.accounts = nil
+	i.registries = map[string]*client.RegistryCollection{}
+	i.credentials = map[string]*client.RegistryCredentialCollection{}
+}
+
+// getProjectByName returns the project called name, or an empty project if
+// there is none.
+func (r *RancherServer) getProjectByName(name string) (*client.Project, error) {
+	projects, err := r.inventory.Projects()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, prj := range projects.Data {
+		if prj.Name == name {
+			project := projects.Data[i]
+			return &project, nil
+		}
+	}
+	return &client.Project{}, nil
+}
@@ -0,0 +1,256 @@
+package rancher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// lockSettingName is the server setting the run lock is kept in.
+const lockSettingName = "rbs.lock"
+
+var (
+	// lockTTL is how long a lease lasts unless renewed. A holder that dies
+	// blocks others for at most this long.
+	lockTTL = 2 * time.Minute
+
+	lockPollInterval = 5 * time.Second
+
+	// lockSettleDelay is how long an acquirer waits before checking it
+	// still holds the lock. Settings have no compare and swap, so of two
+	// runs writing the lock at the same moment the last write wins, and the
+	// other one notices here.
+	lockSettleDelay = 2 * time.Second
+)
+
+// errLockLost fails a run whose lock another run took over.
+var errLockLost = errors.New("Lost the run lock, another run may be changing the server too")
+
+// runLock is the value of the lock setting.
+type runLock struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *runLock) held(now time.Time) bool {
+	return l != nil && l.Holder != "" && now.Before(l.Expires)
+}
+
+// lease is a run lock rbs holds. It is renewed in the background until
+// released, lost is closed when another run took it over.
+type lease struct {
+	client *client.RancherClient
+	holder string
+	stop   chan struct{}
+	done   chan struct{}
+	lost   chan struct{}
+}
+
+// SetLockTimeout sets how long a run waits for another run against the same
+// server to finish before it fails.
+func (r *RancherServer) SetLockTimeout(timeout time.Duration) {
+	r.lockTimeout = timeout
+}
+
+// withLock runs apply while holding the run lock of the server, so runs from
+// several machines do not race each other. When the lock is lost on the way
+// the graph starts no more nodes and the run fails.
+func (r *RancherServer) withLock(apply func() error) error {
+	l, err := r.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer l.release(r)
+
+	r.lockLost = l.lost
+	defer func() { r.lockLost = nil }()
+
+	err = apply()
+	if err == nil && r.lostLock() {
+		return errLockLost
+	}
+	return err
+}
+
+// lostLock tells whether the run lost its lock to another run.
+func (r *RancherServer) lostLock() bool {
+	select {
+	case <-r.lockLost:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *RancherServer) acquireLock() (*lease, error) {
+	holder := lockHolder()
+	deadline := time.Now().Add(r.lockTimeout)
+	waiting := false
+
+	for {
+		current, err := getRunLock(r.client)
+		if err != nil {
+			return nil, err
+		}
+
+		if !current.held(time.Now()) {
+			if err := writeRunLock(r.client, &runLock{Holder: holder, Expires: time.Now().Add(lockTTL)}); err != nil {
+				return nil, err
+			}
+
+			time.Sleep(lockSettleDelay)
+			if current, err = getRunLock(r.client); err != nil {
+				return nil, err
+			}
+			if current != nil && current.Holder == holder {
+				r.log.Debugf("Acquired run lock as %s", holder)
+				l := &lease{
+					client: r.client,
+					holder: holder,
+					stop:   make(chan struct{}),
+					done:   make(chan struct{}),
+					lost:   make(chan struct{}),
+				}
+				go l.renew(r)
+				return l, nil
+			}
+			if !current.held(time.Now()) {
+				continue
+			}
+		}
+
+		if !time.Now().Add(lockPollInterval).Before(deadline) {
+			return nil, fmt.Errorf("Another run holds the lock of this server: %s until %s, use force-unlock if it is gone", current.Holder, current.Expires.Format(time.RFC3339))
+		}
+		if !waiting {
+			r.log.Infof("Waiting for the run of %s to finish", current.Holder)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// renew extends the lease well before it expires, for runs that take longer
+// than lockTTL.
+func (l *lease) renew(r *RancherServer) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			current, err := getRunLock(l.client)
+			if err != nil {
+				r.log.Warnf("Could not renew run lock: %s", err)
+				continue
+			}
+			if current == nil || current.Holder != l.holder {
+				r.log.Errorf("%s", errLockLost)
+				close(l.lost)
+				return
+			}
+			if err := writeRunLock(l.client, &runLock{Holder: l.holder, Expires: time.Now().Add(lockTTL)}); err != nil {
+				r.log.Warnf("Could not renew run lock: %s", err)
+			}
+		}
+	}
+}
+
+func (l *lease) release(r *RancherServer) {
+	close(l.stop)
+	<-l.done
+
+	current, err := getRunLock(l.client)
+	if err == nil && current != nil && current.Holder != l.holder {
+		return
+	}
+	if err == nil {
+		err = writeRunLock(l.client, &runLock{})
+	}
+	if err != nil {
+		r.log.Warnf("Could not release run lock, it expires on its own: %s", err)
+	}
+}
+
+// ForceUnlock removes the run lock whoever holds it, for when a run died
+// and others should not wait for its lease to expire.
+func (r *RancherServer) ForceUnlock() error {
+	current, err := getRunLock(r.client)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Holder == "" {
+		r.log.Infof("The run lock is not held")
+		return nil
+	}
+
+	r.log.Infof("Removing the run lock of %s", current.Holder)
+	return writeRunLock(r.client, &runLock{})
+}
+
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// getRunLock returns the lock kept on the server, nil if there is none.
+func getRunLock(rClient *client.RancherClient) (*runLock, error) {
+	setting, err := rClient.Setting.ById(lockSettingName)
+	if err != nil {
+		return nil, err
+	}
+	if setting == nil || setting.Value == "" {
+		return nil, nil
+	}
+
+	current := &runLock{}
+	if err := json.Unmarshal([]byte(setting.Value), current); err != nil {
+		return nil, fmt.Errorf("Could not parse the run lock: %s\n%s", setting.Value, err)
+	}
+	return current, nil
+}
+
+// writeRunLock stores l on the server, an empty lock frees it.
+func writeRunLock(rClient *client.RancherClient, l *runLock) error {
+	value := ""
+	if l.Holder != "" {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+
+	setting, err := rClient.Setting.ById(lockSettingName)
+	if err != nil {
+		return err
+	}
+	if setting == nil {
+		_, err = rClient.Setting.Create(&client.Setting{
+			Name:  lockSettingName,
+			Value: value,
+		})
+		return err
+	}
+
+	_, err = rClient.Setting.Update(setting, map[string]interface{}{
+		"value": value,
+	})
+	return err
+}
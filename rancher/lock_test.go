@@ -0,0 +1,117 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockExcludesOtherRuns(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	held, err := s.acquireLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := s.connect(t, &RancherBootstrapConfig{})
+	other.SetLockTimeout(50 * time.Millisecond)
+	if _, err := other.acquireLock(); err == nil || !strings.Contains(err.Error(), "Another run holds the lock of this server: "+held.holder) {
+		t.Fatalf("Expected the lock to be taken, got %v", err)
+	}
+
+	held.release(s.RancherServer)
+	l, err := other.acquireLock()
+	if err != nil {
+		t.Fatalf("Expected the released lock to be free, got %s", err)
+	}
+	l.release(other)
+}
+
+func TestLockWaitsForOtherRuns(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	held, err := s.acquireLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.release(s.RancherServer)
+	}()
+
+	other := s.connect(t, &RancherBootstrapConfig{})
+	other.SetLockTimeout(5 * time.Second)
+	l, err := other.acquireLock()
+	if err != nil {
+		t.Fatalf("Expected to get the lock once released, got %s", err)
+	}
+	l.release(other)
+}
+
+func TestLockTakesExpiredLocks(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	if err := writeRunLock(s.client, &runLock{Holder: "gone", Expires: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLockTimeout(0)
+
+	l, err := s.acquireLock()
+	if err != nil {
+		t.Fatalf("Expected the expired lock to be taken, got %s", err)
+	}
+	l.release(s.RancherServer)
+}
+
+func TestLostLockStopsTheRun(t *testing.T) {
+	defer func(ttl time.Duration) { lockTTL = ttl }(lockTTL)
+	lockTTL = 30 * time.Millisecond
+
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	ran := false
+	nodes := []*graphNode{
+		{name: "first", run: func(r *RancherServer) error {
+			if err := writeRunLock(r.client, &runLock{Holder: "other", Expires: time.Now().Add(time.Hour)}); err != nil {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}},
+		{name: "second", deps: []string{"first"}, run: func(r *RancherServer) error {
+			ran = true
+			return nil
+		}},
+	}
+	if err := s.withLock(func() error { return s.runGraph(nodes) }); err != errLockLost {
+		t.Fatalf("Expected the run to fail on the lost lock, got %v", err)
+	}
+	if ran {
+		t.Fatalf("Node started after the lock was lost")
+	}
+	if current, _ := getRunLock(s.client); current == nil || current.Holder != "other" {
+		t.Fatalf("Expected the lock left to the other run, got %#v", current)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+
+	if err := writeRunLock(s.client, &runLock{Holder: "gone", Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ForceUnlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := getRunLock(s.client)
+	if err != nil || current != nil {
+		t.Fatalf("Expected no lock, got %#v, %v", current, err)
+	}
+}
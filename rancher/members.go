@@ -3,45 +3,48 @@ package rancher
 import (
 	"errors"
 	"fmt"
+	"strings"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/client"
 )
 
-func getExistingProjectMembers(projectName string, rClient *client.RancherClient) ([]client.ProjectMember, error) {
-	logrus.Infof("Getting project members for: %s", projectName)
+func (r *RancherServer) getExistingProjectMembers(projectName string) ([]client.ProjectMember, error) {
+	r.log.Infof("Getting project members for: %s", projectName)
 
 	// ToDo: Do not explode if project doesn't exist
 
 	var existing []client.ProjectMember
-	project, err := getProjectByName(projectName, rClient)
+	project, err := r.getProjectByName(projectName)
 	if err != nil {
 		return existing, err
 	}
 
-	existing, err = getProjectMembers(project, rClient)
+	existing, err = getProjectMembers(project, r.client)
 	if err != nil {
 		return existing, err
 	}
 
 	return existing, nil
 }
-func getProjectMemberIdentity(name string, role string, rClient *client.RancherClient) (client.ProjectMember, error) {
-	logrus.Infof("Getting Identity for: %s", name)
+func (r *RancherServer) getProjectMemberIdentity(name string, role string, rClient *client.RancherClient) (client.ProjectMember, error) {
+	r.log.Infof("Getting Identity for: %s", name)
 	var newMember = &client.ProjectMember{}
 	identityCollection, err := rClient.Identity.List(&client.ListOpts{
 		Filters: map[string]interface{}{
 			"name": name,
 		},
 	})
+	if err == nil {
+		err = followPages(rClient, identityCollection)
+	}
 	if err != nil {
 		return *newMember, err
 	}
 
-	var identity client.Identity
-	if len(identityCollection.Data) > 0 {
-		identity = identityCollection.Data[0]
-	} else {
+	// The server searches identities, which may find others with similar
+	// names. Directory names do not tell case apart, an exact match wins.
+	identity := matchIdentity(identityCollection.Data, name)
+	if identity == nil {
 		return *newMember, errors.New(fmt.Sprintf("Could not get Identity: %s\n Got: %#v", name, identityCollection))
 	}
 
@@ -52,17 +55,39 @@ func getProjectMemberIdentity(name string, role string, rClient *client.RancherC
 	return *newMember, nil
 }
 
-func addEnvironmentMembers(projectName string, members []client.ProjectMember, rClient *client.RancherClient) error {
+func matchIdentity(identities []client.Identity, name string) *client.Identity {
+	var match *client.Identity
+	for i, identity := range identities {
+		if identity.Name == name {
+			return &identities[i]
+		}
+		if match == nil && strings.EqualFold(identity.Name, name) {
+			match = &identities[i]
+		}
+	}
+	return match
+}
+
+func projectMemberExists(members []client.ProjectMember, member client.ProjectMember) bool {
+	for _, existing := range members {
+		if existing.ExternalId == member.ExternalId && existing.ExternalIdType == member.ExternalIdType && existing.Role == member.Role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RancherServer) addEnvironmentMembers(projectName string, members []client.ProjectMember) error {
 	setProjectMembersInput := &client.SetProjectMembersInput{
 		Members: members,
 	}
 
-	project, err := getProjectByName(projectName, rClient)
+	project, err := r.getProjectByName(projectName)
 	if err != nil {
 		return err
 	}
 
-	_, err = rClient.Project.ActionSetmembers(project, setProjectMembersInput)
+	_, err = r.client.Project.ActionSetmembers(project, setProjectMembersInput)
 	if err != nil {
 		return err
 	}
@@ -71,28 +96,9 @@ func addEnvironmentMembers(projectName string, members []client.ProjectMember, r
 }
 
 func getProjectMembers(project *client.Project, rClient *client.RancherClient) ([]client.ProjectMember, error) {
-	var projectMembers client.ProjectMemberCollection
-	err := rClient.GetLink(project.Resource, "projectMembers", &projectMembers)
-	return projectMembers.Data, err
-}
-
-func getProjectByName(name string, rClient *client.RancherClient) (*client.Project, error) {
-	var project client.Project
-	projects, err := rClient.Project.List(&client.ListOpts{})
-	if err != nil {
-		logrus.Fatalf("Could not get project ID for %s", name)
-		return &project, nil
-	}
-
-	if len(projects.Data) == 0 {
-		return &project, nil
+	projectMembers := &client.ProjectMemberCollection{}
+	if err := listLink(rClient, project.Resource, "projectMembers", projectMembers); err != nil {
+		return nil, err
 	}
-
-	for _, prj := range projects.Data {
-		if prj.Name == name {
-			project = prj
-		}
-	}
-
-	return &project, nil
+	return projectMembers.Data, nil
 }
@@ -0,0 +1,102 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestApplyAddsMembers(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Memberships: map[string]map[string]*client.Identity{
+			"dev": {
+				"ops": {Name: "ops", Role: "owner"},
+			},
+		},
+	})
+	defer s.Close()
+	s.fake.Add("identity", &client.Identity{Name: "ops", ExternalId: "cn=ops,dc=example,dc=com", ExternalIdType: "ldap_group"})
+	s.fake.Add("identity", &client.Identity{Name: "dev", ExternalId: "cn=dev,dc=example,dc=com", ExternalIdType: "ldap_group"})
+
+	s.apply(t)
+
+	members := []client.ProjectMember{}
+	s.fake.List("projectMember", &members)
+	if len(members) != 1 || members[0].ExternalId != "cn=ops,dc=example,dc=com" || members[0].Role != "owner" {
+		t.Fatalf("Expected ops as owner, got %#v", members)
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+
+	s.config.Memberships["dev"]["dev"] = &client.Identity{Name: "dev", Role: "member"}
+	s.apply(t)
+	s.fake.List("projectMember", &members)
+	if len(members) != 2 {
+		t.Fatalf("Expected ops and dev, got %#v", members)
+	}
+}
+
+func TestApplyFailsOnUnknownIdentities(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Memberships: map[string]map[string]*client.Identity{
+			"dev": {
+				"nobody": {Name: "nobody", Role: "owner"},
+			},
+		},
+	})
+	defer s.Close()
+
+	status := s.ApplyOnce()
+	if status.Success || !strings.Contains(status.Error, "Could not get Identity: nobody") {
+		t.Fatalf("Expected the run to fail, got %#v", status)
+	}
+}
+
+func TestApplyKeepsMembersPastFirstPage(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Memberships: map[string]map[string]*client.Identity{
+			"dev": {
+				"ops": {Name: "ops", Role: "owner"},
+			},
+		},
+	})
+	defer s.Close()
+	s.fake.PageSize = 2
+	s.fake.Add("identity", &client.Identity{Name: "ops", ExternalId: "cn=ops,dc=example,dc=com", ExternalIdType: "ldap_group"})
+	project := s.fake.Add("project", &client.Project{Name: "dev"})
+	for _, name := range []string{"alice", "bob", "carol"} {
+		s.fake.Add("projectMember", &client.ProjectMember{ExternalId: "uid=" + name, ExternalIdType: "ldap_user", Role: "member", ProjectId: project})
+	}
+
+	s.apply(t)
+
+	members := []client.ProjectMember{}
+	s.fake.List("projectMember", &members)
+	if len(members) != 4 {
+		t.Fatalf("Expected the 3 members and ops, got %#v", members)
+	}
+}
+
+func TestMatchIdentity(t *testing.T) {
+	identities := []client.Identity{{Name: "Ops Team"}, {Name: "ops"}, {Name: "OPS"}}
+	for name, expected := range map[string]string{"ops": "ops", "Ops": "ops", "OPS": "OPS", "ops team": "Ops Team"} {
+		if identity := matchIdentity(identities, name); identity == nil || identity.Name != expected {
+			t.Errorf("Expected %s for %s, got %#v", expected, name, identity)
+		}
+	}
+	if identity := matchIdentity(identities, "op"); identity != nil {
+		t.Errorf("Expected no identity for op, got %#v", identity)
+	}
+}
@@ -0,0 +1,301 @@
+package rancher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the API latency histogram buckets.
+var apiLatencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metrics = newMetricsRegistry()
+
+type apiCallKey struct {
+	server   string
+	endpoint string
+	method   string
+	code     string
+}
+
+type apiCallKeys []apiCallKey
+
+func (k apiCallKeys) Len() int           { return len(k) }
+func (k apiCallKeys) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k apiCallKeys) Less(i, j int) bool { return fmt.Sprint(k[i]) < fmt.Sprint(k[j]) }
+
+type apiCallStats struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type changeKey struct {
+	kind   string
+	action string
+}
+
+type changeKeys []changeKey
+
+func (k changeKeys) Len() int      { return len(k) }
+func (k changeKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k changeKeys) Less(i, j int) bool {
+	if k[i].kind != k[j].kind {
+		return k[i].kind < k[j].kind
+	}
+	return k[i].action < k[j].action
+}
+
+// metricsRegistry holds everything rbs reports to Prometheus. It is written
+// out in the text exposition format by hand, there are few enough metrics
+// not to need the client library.
+type metricsRegistry struct {
+	sync.Mutex
+	runs            map[bool]uint64
+	lastRunDuration float64
+	lastRunSuccess  bool
+	lastSuccess     time.Time
+	changes         map[changeKey]uint64
+	drift           map[string]int
+	apiCalls        map[apiCallKey]*apiCallStats
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		runs:     map[bool]uint64{},
+		changes:  map[changeKey]uint64{},
+		drift:    map[string]int{},
+		apiCalls: map[apiCallKey]*apiCallStats{},
+	}
+}
+
+// observeRun records the outcome of a run. Drift per project is only
+// replaced by full runs, a run for a few targets does not see the rest.
+func (m *metricsRegistry) observeRun(status *RunStatus) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.runs[status.Success]++
+	m.lastRunDuration = status.Finished.Sub(status.Started).Seconds()
+	m.lastRunSuccess = status.Success
+	if status.Success {
+		m.lastSuccess = status.Finished
+	}
+
+	for _, change := range status.Changes {
+		m.changes[changeKey{change.Kind, change.Action}]++
+	}
+
+	if len(status.Targets) == 0 {
+		m.drift = map[string]int{}
+		for _, change := range status.Changes {
+			m.drift[change.Project]++
+		}
+	}
+}
+
+func (m *metricsRegistry) observeAPICall(key apiCallKey, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	stats, ok := m.apiCalls[key]
+	if !ok {
+		stats = &apiCallStats{buckets: make([]uint64, len(apiLatencyBuckets))}
+		m.apiCalls[key] = stats
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range apiLatencyBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+	stats.count++
+	stats.sum += seconds
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *metricsRegistry) WriteTo(out io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	writeHeader(buf, "rbs_runs_total", "counter", "Reconcile runs by result.")
+	fmt.Fprintf(buf, "rbs_runs_total{result=\"success\"} %d\n", m.runs[true])
+	fmt.Fprintf(buf, "rbs_runs_total{result=\"failure\"} %d\n", m.runs[false])
+
+	writeHeader(buf, "rbs_last_run_duration_seconds", "gauge", "Duration of the last reconcile run.")
+	fmt.Fprintf(buf, "rbs_last_run_duration_seconds %g\n", m.lastRunDuration)
+
+	writeHeader(buf, "rbs_last_run_success", "gauge", "Whether the last reconcile run succeeded.")
+	fmt.Fprintf(buf, "rbs_last_run_success %d\n", boolToInt(m.lastRunSuccess))
+
+	writeHeader(buf, "rbs_last_success_timestamp_seconds", "gauge", "Unix time the last successful reconcile run finished, 0 if none did.")
+	lastSuccess := int64(0)
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = m.lastSuccess.Unix()
+	}
+	fmt.Fprintf(buf, "rbs_last_success_timestamp_seconds %d\n", lastSuccess)
+
+	writeHeader(buf, "rbs_resource_changes_total", "counter", "Resources created, updated and deleted by kind.")
+	changeKeys := changeKeys{}
+	for key := range m.changes {
+		changeKeys = append(changeKeys, key)
+	}
+	sort.Sort(changeKeys)
+	for _, key := range changeKeys {
+		fmt.Fprintf(buf, "rbs_resource_changes_total{kind=%q,action=%q} %d\n", key.kind, key.action, m.changes[key])
+	}
+
+	writeHeader(buf, "rbs_drift", "gauge", "Changes the last full run had to make, by project. An empty project is server wide.")
+	projects := []string{}
+	for project := range m.drift {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		fmt.Fprintf(buf, "rbs_drift{project=%q} %d\n", project, m.drift[project])
+	}
+
+	writeHeader(buf, "rbs_api_request_duration_seconds", "histogram", "Latency of Rancher API calls by endpoint, method and status code, _count is the number of calls.")
+	apiKeys := apiCallKeys{}
+	for key := range m.apiCalls {
+		apiKeys = append(apiKeys, key)
+	}
+	sort.Sort(apiKeys)
+	for _, key := range apiKeys {
+		stats := m.apiCalls[key]
+		labels := fmt.Sprintf("server=%q,endpoint=%q,method=%q,code=%q", key.server, key.endpoint, key.method, key.code)
+		for i, bound := range apiLatencyBuckets {
+			fmt.Fprintf(buf, "rbs_api_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, stats.buckets[i])
+		}
+		fmt.Fprintf(buf, "rbs_api_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, stats.count)
+		fmt.Fprintf(buf, "rbs_api_request_duration_seconds_sum{%s} %g\n", labels, stats.sum)
+		fmt.Fprintf(buf, "rbs_api_request_duration_seconds_count{%s} %d\n", labels, stats.count)
+	}
+
+	return buf.WriteTo(out)
+}
+
+func writeHeader(out io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(w)
+}
+
+// WriteMetricsFile writes the metrics for the node_exporter textfile
+// collector. The file is replaced in one go so the collector never reads
+// half of it.
+func WriteMetricsFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Could not write metrics: %s\n%s", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := metrics.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var (
+	instrumentOnce sync.Once
+	instrumented   = struct {
+		sync.Mutex
+		hosts map[string]bool
+	}{hosts: map[string]bool{}}
+)
+
+// instrumentAPICalls times the calls made to host. The vendored client has
+// no hooks, but all of its requests go through the default transport.
+func instrumentAPICalls(host string) {
+	instrumented.Lock()
+	instrumented.hosts[host] = true
+	instrumented.Unlock()
+
+	instrumentOnce.Do(func() {
+		http.DefaultTransport = &metricsTransport{next: http.DefaultTransport}
+	})
+}
+
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	instrumented.Lock()
+	watched := instrumented.hosts[req.URL.Host]
+	instrumented.Unlock()
+
+	if !watched {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	metrics.observeAPICall(apiCallKey{
+		server:   req.URL.Host,
+		endpoint: apiEndpoint(req),
+		method:   req.Method,
+		code:     code,
+	}, time.Since(start))
+
+	return resp, err
+}
+
+var projectScopePattern = regexp.MustCompile(`^/v1/projects/[^/]+/`)
+
+// apiEndpoint names the endpoint of an API request without ids, so calls
+// to the same kind of resource are counted together.
+func apiEndpoint(req *http.Request) string {
+	path := projectScopePattern.ReplaceAllString(req.URL.Path, "/v1/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	endpoint := parts[0]
+	if len(parts) > 1 {
+		endpoint = parts[1]
+	}
+	if len(parts) > 2 {
+		endpoint += "/{id}"
+	}
+	if len(parts) > 3 {
+		endpoint += "/" + strings.Join(parts[3:], "/")
+	}
+	if action := req.URL.Query().Get("action"); action != "" {
+		endpoint += "?action=" + action
+	}
+	return endpoint
+}
@@ -0,0 +1,26 @@
+package rancher
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	for url, expected := range map[string]string{
+		"http://rancher/v1/projects":                               "projects",
+		"http://rancher/v1/projects/1a5":                           "projects/{id}",
+		"http://rancher/v1/projects/1a5?action=setmembers":         "projects/{id}?action=setmembers",
+		"http://rancher/v1/projects/1a5/registries":                "registries",
+		"http://rancher/v1/projects/1a5/registrycredentials/1c7":   "registrycredentials/{id}",
+		"http://rancher/v1/projects/1a5/environments/1e2/services": "environments/{id}/services",
+		"http://rancher/v1/settings/rbs.lock":                      "settings/{id}",
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint := apiEndpoint(req); endpoint != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, url, endpoint)
+		}
+	}
+}
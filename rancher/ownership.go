@@ -0,0 +1,149 @@
+package rancher
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ownershipKey is the key of the marker in the Data of the resources rbs
+// creates, for tools. The Description carries the same for operators.
+const ownershipKey = "rbs"
+
+var ownershipPattern = regexp.MustCompile(`\s*\[Managed by rbs[^\]]*\]$`)
+
+// ownership describes who created a resource.
+type ownership struct {
+	Source  string `json:"source"`
+	Created string `json:"created"`
+}
+
+func (r *RancherServer) newOwnership() *ownership {
+	return &ownership{
+		Source:  filepath.Base(r.configFile),
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// description returns the description of a new resource with the marker
+// appended, description being what the config asks for.
+func (o *ownership) description(description string) string {
+	marker := fmt.Sprintf("[Managed by rbs from %s since %s, do not edit by hand]", o.Source, o.Created)
+	if description == "" {
+		return marker
+	}
+	return description + " " + marker
+}
+
+// data returns the Data of a new resource with the marker added.
+func (o *ownership) data(data map[string]interface{}) map[string]interface{} {
+	marked := map[string]interface{}{}
+	for key, value := range data {
+		marked[key] = value
+	}
+	marked[ownershipKey] = map[string]interface{}{
+		"source":  o.Source,
+		"created": o.Created,
+	}
+	return marked
+}
+
+// isManaged tells whether a resource carries the marker of rbs, in either its
+// Data or its Description.
+func isManaged(description string, data map[string]interface{}) bool {
+	if marker, ok := data[ownershipKey].(map[string]interface{}); ok && marker["source"] != nil {
+		return true
+	}
+	return ownershipPattern.MatchString(description)
+}
+
+// secretHashKey is what secrets are hashed with, the secret key of the admin
+// API key rbs runs with. The server only keeps a hash of it, so whoever can
+// read a resource cannot check guesses of its secret against the marker.
+func (r *RancherServer) secretHashKey() []byte {
+	return []byte(r.client.Opts.SecretKey)
+}
+
+// withSecretHash returns a copy of data whose marker holds a salted HMAC of
+// secret under key. Servers do not hand secrets back, so this is what tells
+// whether the configured one changed. Resources rbs did not create get a
+// marker with only the hash, which does not make them managed.
+func withSecretHash(data map[string]interface{}, key []byte, secret string) (map[string]interface{}, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("Could not salt the secret hash: %s", err)
+	}
+
+	marker := map[string]interface{}{}
+	if existing, ok := data[ownershipKey].(map[string]interface{}); ok {
+		for key, value := range existing {
+			marker[key] = value
+		}
+	}
+	marker["secretHash"] = hex.EncodeToString(salt) + ":" + hashSecret(key, salt, secret)
+
+	hashed := map[string]interface{}{}
+	for key, value := range data {
+		hashed[key] = value
+	}
+	hashed[ownershipKey] = marker
+	return hashed, nil
+}
+
+// secretMatches tells whether secret is the one hashed under key into the
+// marker of data. Without a hash, or with one made under another key, it
+// does not match.
+func secretMatches(data map[string]interface{}, key []byte, secret string) bool {
+	marker, _ := data[ownershipKey].(map[string]interface{})
+	stored, _ := marker["secretHash"].(string)
+
+	parts := strings.SplitN(stored, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(hashSecret(key, salt, secret)), []byte(parts[1]))
+}
+
+func hashSecret(key []byte, salt []byte, secret string) string {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(salt)
+	hash.Write([]byte(secret))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// unmarkedDescription returns description without the marker, which is what
+// compares to the config.
+func unmarkedDescription(description string) string {
+	return ownershipPattern.ReplaceAllString(description, "")
+}
+
+// markedDescription returns the description to update a resource to, which
+// keeps the marker it has.
+func markedDescription(existing string, description string) string {
+	marker := strings.TrimSpace(ownershipPattern.FindString(existing))
+	if marker == "" {
+		return description
+	}
+	if description == "" {
+		return marker
+	}
+	return description + " " + marker
+}
+
+// checkManaged warns before rbs changes a resource it did not create, which
+// is likely to have been made by hand.
+func (r *RancherServer) checkManaged(kind string, name string, description string, data map[string]interface{}) {
+	if !isManaged(description, data) {
+		r.log.Warnf("The %s %s was not created by rbs, changing it anyway", kind, name)
+	}
+}
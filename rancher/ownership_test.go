@@ -0,0 +1,58 @@
+package rancher
+
+import "testing"
+
+func TestOwnershipMarker(t *testing.T) {
+	owner := &ownership{Source: "config.yml", Created: "2017-01-02T03:04:05Z"}
+
+	description := owner.description("Development")
+	if description != "Development [Managed by rbs from config.yml since 2017-01-02T03:04:05Z, do not edit by hand]" {
+		t.Fatalf("Unexpected description: %s", description)
+	}
+	if !isManaged(description, nil) || unmarkedDescription(description) != "Development" {
+		t.Fatalf("Marker not recognized in: %s", description)
+	}
+	if !isManaged("", owner.data(nil)) {
+		t.Fatalf("Marker not recognized in data")
+	}
+	if isManaged("Development", map[string]interface{}{"other": true}) {
+		t.Fatalf("Unmarked resource taken as managed")
+	}
+
+	if updated := markedDescription(description, "Testing"); unmarkedDescription(updated) != "Testing" || !isManaged(updated, nil) {
+		t.Fatalf("Update lost the marker: %s", updated)
+	}
+	if updated := markedDescription("Development", "Testing"); updated != "Testing" {
+		t.Fatalf("Update added a marker: %s", updated)
+	}
+}
+
+func TestSecretHash(t *testing.T) {
+	owner := &ownership{Source: "config.yml", Created: "2017-01-02T03:04:05Z"}
+	key := []byte("admin-secret")
+	data, err := withSecretHash(owner.data(nil), key, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !secretMatches(data, key, "s3cret") || secretMatches(data, key, "wrong") {
+		t.Fatalf("Hash does not tell the secrets apart: %#v", data)
+	}
+	if secretMatches(data, []byte("other-secret"), "s3cret") {
+		t.Fatalf("Hash matches under another key: %#v", data)
+	}
+	if !isManaged("", data) {
+		t.Fatalf("Hashing lost the marker: %#v", data)
+	}
+	if secretMatches(owner.data(nil), key, "s3cret") {
+		t.Fatalf("Expected no match without a hash")
+	}
+
+	unmanaged, err := withSecretHash(map[string]interface{}{"other": true}, key, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isManaged("", unmanaged) || !secretMatches(unmanaged, key, "s3cret") || unmanaged["other"] != true {
+		t.Fatalf("Unexpected data of an unmanaged resource: %#v", unmanaged)
+	}
+}
@@ -0,0 +1,58 @@
+package rancher
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// getNextPage loads the page following collection into output. It returns
+// false when collection is the last page.
+func getNextPage(rClient *client.RancherClient, collection *client.Collection, output interface{}) (bool, error) {
+	if collection.Pagination == nil || collection.Pagination.Next == "" {
+		return false, nil
+	}
+
+	next := client.Resource{
+		Links: map[string]string{
+			"next": collection.Pagination.Next,
+		},
+	}
+	return true, rClient.GetLink(next, "next", output)
+}
+
+// followPages turns the first page of a list into the whole list, appending
+// the pages following it to its Data. collection is a pointer to a
+// collection type like the generated ones, such as *client.ProjectCollection,
+// which embed client.Collection next to their Data.
+func followPages(rClient *client.RancherClient, collection interface{}) error {
+	value := reflect.ValueOf(collection)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Not a collection: %T", collection)
+	}
+	data := value.Elem().FieldByName("Data")
+	embedded := value.Elem().FieldByName("Collection")
+	if data.Kind() != reflect.Slice || !embedded.IsValid() || embedded.Type() != reflect.TypeOf(client.Collection{}) {
+		return fmt.Errorf("Not a collection: %T", collection)
+	}
+	page := embedded.Addr().Interface().(*client.Collection)
+
+	for {
+		next := reflect.New(value.Elem().Type())
+		more, err := getNextPage(rClient, page, next.Interface())
+		if err != nil || !more {
+			return err
+		}
+		data.Set(reflect.AppendSlice(data, next.Elem().FieldByName("Data")))
+		page = next.Elem().FieldByName("Collection").Addr().Interface().(*client.Collection)
+	}
+}
+
+// listLink lists the collection resource links to, all pages of it.
+func listLink(rClient *client.RancherClient, resource client.Resource, link string, collection interface{}) error {
+	if err := rClient.GetLink(resource, link, collection); err != nil {
+		return err
+	}
+	return followPages(rClient, collection)
+}
@@ -0,0 +1,35 @@
+package rancher
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestFollowPages(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+	s.fake.PageSize = 2
+	for i := 0; i < 5; i++ {
+		s.fake.Add("setting", &client.Setting{Name: fmt.Sprintf("setting%d", i)})
+	}
+
+	settings, err := s.client.Setting.List(&client.ListOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Data) != 2 {
+		t.Fatalf("Expected a first page of 2, got %d", len(settings.Data))
+	}
+	if err := followPages(s.client, settings); err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Data) != 5 || settings.Data[4].Name != "setting4" {
+		t.Fatalf("Expected all 5 settings in order, got %#v", settings.Data)
+	}
+
+	if err := followPages(s.client, &client.Setting{}); err == nil {
+		t.Fatalf("Expected a setting not to be taken for a collection")
+	}
+}
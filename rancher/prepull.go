@@ -0,0 +1,171 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// ConfigurePrepull pulls the configured images onto the hosts of each project.
+// It runs after registries and their credentials are configured, so a
+// successful pull also proves the credentials work.
+func (r *RancherServer) ConfigurePrepull() error {
+	for projectName, pullTasks := range r.config.Prepull {
+		if err := r.configureProjectPrepull(projectName, pullTasks); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureProjectPrepull(projectName string, pullTasks []*client.PullTask) error {
+	r.log.Infof("Pre-pulling images for project: %s", projectName)
+	project, err := r.getProjectByName(projectName)
+	if err != nil {
+		return err
+	}
+	if project.Id == "" {
+		return fmt.Errorf("Project %s does not exist", projectName)
+	}
+
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, pullTask := range pullTasks {
+		if !r.selected("image", pullTask.Image) {
+			continue
+		}
+
+		failures, err := r.pullImage(projectClient, pullTask)
+		if err != nil {
+			return err
+		}
+		failed += failures
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to pull %d image(s) for project: %s", failed, projectName)
+	}
+
+	return nil
+}
+
+// pullImage runs a pull task and reports the hosts it failed on. It returns
+// the number of failed hosts. Images an earlier pull task of the same image,
+// mode and labels pulled everywhere are not pulled again, or every run would
+// pull them.
+func (r *RancherServer) pullImage(prjClient *client.RancherClient, pullTask *client.PullTask) (int, error) {
+	mode := pullTask.Mode
+	if mode == "" {
+		mode = "all"
+	}
+
+	pulled, err := imagePulled(prjClient, pullTask.Image, mode, pullTask.Labels)
+	if err != nil {
+		return 0, err
+	}
+	if pulled {
+		r.log.Debugf("Image already pulled: %s", pullTask.Image)
+		return 0, nil
+	}
+
+	r.log.Infof("Pulling image: %s", pullTask.Image)
+	task, err := prjClient.PullTask.Create(&client.PullTask{
+		Image:  pullTask.Image,
+		Labels: pullTask.Labels,
+		Mode:   mode,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = WaitFor(prjClient, &task.Resource, task, func() string {
+		return task.Transitioning
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if task.Transitioning == "error" || task.State == "error" {
+		r.log.Errorf("Pull of %s failed: %s", task.Image, task.TransitioningMessage)
+		return 1, nil
+	}
+
+	failed := 0
+	for hostId, status := range task.Status {
+		if strings.EqualFold(fmt.Sprintf("%v", status), "done") {
+			continue
+		}
+		failed++
+		r.log.Errorf("Pull of %s failed on host %s: %v", task.Image, getHostName(prjClient, hostId), status)
+	}
+
+	return failed, nil
+}
+
+// imagePulled tells whether a pull task of image with mode and labels
+// succeeded on all of its hosts before.
+func imagePulled(prjClient *client.RancherClient, image string, mode string, labels map[string]interface{}) (bool, error) {
+	tasks, err := prjClient.PullTask.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"image": image,
+		},
+	})
+	if err == nil {
+		err = followPages(prjClient, tasks)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, task := range tasks.Data {
+		if task.Image != image || task.Mode != mode || !labelsEqual(task.Labels, labels) {
+			continue
+		}
+		if task.State != "error" && task.Transitioning == "no" && len(task.Status) > 0 && allDone(task.Status) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func allDone(status map[string]interface{}) bool {
+	for _, hostStatus := range status {
+		if !strings.EqualFold(fmt.Sprintf("%v", hostStatus), "done") {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsEqual(a map[string]interface{}, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		other, ok := b[key]
+		if !ok || fmt.Sprintf("%v", value) != fmt.Sprintf("%v", other) {
+			return false
+		}
+	}
+	return true
+}
+
+func getHostName(prjClient *client.RancherClient, hostId string) string {
+	host, err := prjClient.Host.ById(hostId)
+	if err != nil || host == nil {
+		return hostId
+	}
+	if host.Name != "" {
+		return host.Name
+	}
+	if host.Hostname != "" {
+		return host.Hostname
+	}
+	return hostId
+}
@@ -0,0 +1,45 @@
+package rancher
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func (s *testServer) pullTasks() []client.PullTask {
+	tasks := []client.PullTask{}
+	s.fake.List("pullTask", &tasks)
+	return tasks
+}
+
+func TestApplyPullsImagesOnce(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Prepull: map[string][]*client.PullTask{
+			"dev": {{Image: "nginx:1.11"}},
+		},
+	})
+	defer s.Close()
+
+	// Without hosts nothing was pulled, so the next run pulls again.
+	s.apply(t)
+	s.fake.Add("host", &client.Host{Name: "worker", AccountId: s.projects()[0].Id})
+	s.apply(t)
+	tasks := s.pullTasks()
+	if len(tasks) != 2 || len(tasks[1].Status) != 1 {
+		t.Fatalf("Expected a pull onto the new host, got %#v", tasks)
+	}
+
+	s.apply(t)
+	if tasks := s.pullTasks(); len(tasks) != 2 {
+		t.Fatalf("Pulled image pulled again: %#v", tasks[2:])
+	}
+
+	s.config.Prepull["dev"][0].Labels = map[string]interface{}{"role": "web"}
+	s.apply(t)
+	if tasks := s.pullTasks(); len(tasks) != 3 || tasks[2].Labels["role"] != "web" {
+		t.Fatalf("Expected a pull onto the hosts labelled role=web, got %#v", tasks)
+	}
+}
@@ -0,0 +1,208 @@
+package rancher
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	projectKeyName        = "rbs-project-key"
+	projectKeyDescription = "Temporary project key created by rbs, safe to remove"
+
+	// Keys older than this are left over from runs that did not clean up.
+	projectKeyStaleAfter = time.Hour
+)
+
+// projectClients hands out one client per project for the duration of a run.
+// Every client is backed by a temporary project API key, which is removed by
+// Close.
+type projectClients struct {
+	sync.Mutex
+	url      string
+	client   *client.RancherClient
+	projects map[string]*projectClient
+
+	// log is where Close logs to, Get logs to the log of its caller.
+	log *logrus.Entry
+}
+
+// projectClient is the client of one project and the key backing it. Its
+// lock is held while the key is created, so that graph nodes of other
+// projects do not wait on it.
+type projectClient struct {
+	sync.Mutex
+	client *client.RancherClient
+	key    *client.ApiKey
+}
+
+func newProjectClients(url string, rClient *client.RancherClient, log *logrus.Entry) *projectClients {
+	return &projectClients{
+		url:      url,
+		client:   rClient,
+		projects: map[string]*projectClient{},
+		log:      log,
+	}
+}
+
+// Get returns the client of project, creating its key when it is the first
+// one asked for in this run. It logs to log.
+func (p *projectClients) Get(project *client.Project, log *logrus.Entry) (*client.RancherClient, error) {
+	p.Lock()
+	entry, ok := p.projects[project.Id]
+	if !ok {
+		entry = &projectClient{}
+		p.projects[project.Id] = entry
+	}
+	p.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.client != nil {
+		return entry.client, nil
+	}
+
+	if entry.key == nil {
+		projectKeys, err := createProjectApiKey(p.client, project, log)
+		if err != nil {
+			log.Errorf("Unable to create project keys")
+			return nil, err
+		}
+		// Kept before waiting for it, Close removes it even if the wait
+		// fails.
+		entry.key = projectKeys
+	}
+
+	projectKeys := entry.key
+	err := WaitFor(p.client, &projectKeys.Resource, projectKeys, func() string {
+		return projectKeys.Transitioning
+	})
+	if err != nil {
+		log.Errorf("Unable to create project keys")
+		return nil, err
+	}
+
+	projectClient, err := getRancherClient(&client.ClientOpts{
+		Url:       p.url + "/projects/" + project.Id,
+		AccessKey: projectKeys.PublicValue,
+		SecretKey: projectKeys.SecretValue,
+	})
+	if err != nil {
+		log.Errorf("Could not get client")
+		return nil, err
+	}
+	log.Debugf("Created client for project: %s", project.Name)
+
+	entry.client = projectClient
+	return projectClient, nil
+}
+
+// Close removes the API keys of all clients handed out so far.
+func (p *projectClients) Close() {
+	p.Lock()
+	defer p.Unlock()
+
+	for projectId, entry := range p.projects {
+		entry.Lock()
+		if key := entry.key; key != nil {
+			p.log.Debugf("Removing key for: %s", projectId)
+			if err := p.client.ApiKey.Delete(key); err != nil {
+				p.log.Warnf("Could not remove project key %s: %s", key.PublicValue, err)
+			}
+		}
+		entry.Unlock()
+		delete(p.projects, projectId)
+	}
+}
+
+// sweepStaleProjectKeys removes temporary project keys that earlier runs
+// failed to clean up.
+func sweepStaleProjectKeys(rClient *client.RancherClient, log *logrus.Entry) error {
+	keys, err := rClient.ApiKey.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"name": projectKeyName,
+		},
+	})
+	if err == nil {
+		err = followPages(rClient, keys)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys.Data {
+		if key.Name != projectKeyName || key.Description != projectKeyDescription || key.State == "removed" || key.State == "purged" {
+			continue
+		}
+
+		created, err := time.Parse(time.RFC3339, key.Created)
+		if err != nil || time.Since(created) < projectKeyStaleAfter {
+			continue
+		}
+
+		log.Infof("Removing stale project key: %s", key.PublicValue)
+		if err := rClient.ApiKey.Delete(&keys.Data[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close releases the resources rbs created for the duration of a run.
+func (r *RancherServer) Close() {
+	r.projectClients.Close()
+}
+
+var closeOnExit = struct {
+	sync.Mutex
+	once    sync.Once
+	servers []*RancherServer
+}{}
+
+// CloseOnExit makes sure Close runs when the process is interrupted or exits
+// through logrus.Fatal, neither of which runs deferred calls.
+func (r *RancherServer) CloseOnExit() {
+	closeOnExit.Lock()
+	closeOnExit.servers = append(closeOnExit.servers, r)
+	closeOnExit.Unlock()
+
+	closeOnExit.once.Do(func() {
+		logrus.AddHook(&closeHook{})
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logrus.Warnf("Received %s, cleaning up", sig)
+			closeAll()
+			os.Exit(1)
+		}()
+	})
+}
+
+func closeAll() {
+	closeOnExit.Lock()
+	defer closeOnExit.Unlock()
+
+	for _, server := range closeOnExit.servers {
+		server.Close()
+	}
+}
+
+type closeHook struct{}
+
+func (h *closeHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel}
+}
+
+func (h *closeHook) Fire(entry *logrus.Entry) error {
+	closeAll()
+	return nil
+}
@@ -1,7 +1,10 @@
 package rancher
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cloudfoundry-incubator/candiedyaml"
@@ -9,51 +12,149 @@ import (
 )
 
 type RancherServer struct {
-	client *client.RancherClient
-	config *RancherBootstrapConfig
+	client         *client.RancherClient
+	config         *RancherBootstrapConfig
+	projectClients *projectClients
+	inventory      *inventory
+	changes        *changeLog
+	parallelism    int
+	filter         *nodeFilter
+	state          *state
+	configFile     string
+	lockTimeout    time.Duration
+	backupDir      string
+
+	// revertOnFailure rolls a failed run back to the backup taken before it.
+	revertOnFailure bool
+
+	// lockLost is closed when the run lost its lock, see withLock.
+	lockLost <-chan struct{}
+
+	// log is where the configure steps log to, the graph gives each node
+	// its own so their output can be grouped.
+	log *logrus.Entry
 }
 
 func NewRancherServer(configFile string, keyFile string) *RancherServer {
-	file, err := os.Open(configFile)
+	config, err := loadConfig(configFile)
 	if err != nil {
-		logrus.Fatalf("File does not exist: %s\n%s", configFile, err)
+		logrus.Fatal(err)
 	}
-	defer file.Close()
 
-	config := &RancherBootstrapConfig{}
-	decoder := candiedyaml.NewDecoder(file)
-	if err = decoder.Decode(&config); err != nil {
-		logrus.Fatalf("Could not parse config: %s", err.Error())
+	r, err := newRancherServer(config, configFile, keyFile, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		logrus.Fatal(err)
 	}
+	return r
+}
 
-	logrus.Infof("Using Rancher URL: %s", config.Server.URL)
+// newRancherServer connects to the server of config, logging to log.
+// configFile is only used to mark the resources rbs creates.
+func newRancherServer(config *RancherBootstrapConfig, configFile string, keyFile string, log *logrus.Entry) (*RancherServer, error) {
+	log.Infof("Using Rancher URL: %s", config.Server.URL)
+
+	serverURL, err := url.Parse(config.Server.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid server url: %s", config.Server.URL)
+	}
+	instrumentAPICalls(serverURL.Host)
+	dropContentLengthHeader()
 
 	opts := &client.ClientOpts{
 		Url: config.Server.URL,
 	}
 
-	setOptAdminKeys(opts, keyFile)
+	// Without a key file, which is normal on the first run, new keys are
+	// created below.
+	if err := setOptAdminKeys(opts, keyFile); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		log.Warnf("Keys could not be opened\n %s", err.Error())
+	}
 
-	rClient, _ := getRancherClient(opts)
+	rClient, err := getRancherClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s\n%s", config.Server.URL, err)
+	}
 
 	if opts.AccessKey == "" || opts.SecretKey == "" {
-		adminKeys, _ := generateAndSetAdminApiKeys(rClient, keyFile)
+		adminKeys, err := generateAndSetAdminApiKeys(rClient, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create admin keys for %s\n%s", config.Server.URL, err)
+		}
 		rClient.Opts.AccessKey = adminKeys.PublicValue
 		rClient.Opts.SecretKey = adminKeys.SecretValue
 	}
 
-	logrus.Infof("Using Access Key: %s", rClient.Opts.AccessKey)
+	log.Infof("Using Access Key: %s", rClient.Opts.AccessKey)
+
+	if err := sweepStaleProjectKeys(rClient, log); err != nil {
+		log.Warnf("Could not remove stale project keys: %s", err)
+	}
 
 	return &RancherServer{
-		client: rClient,
-		config: config,
+		client:         rClient,
+		config:         config,
+		projectClients: newProjectClients(config.Server.URL, rClient, log),
+		inventory:      newInventory(rClient),
+		changes:        &changeLog{},
+		parallelism:    1,
+		filter:         &nodeFilter{},
+		configFile:     configFile,
+		lockTimeout:    5 * time.Minute,
+		log:            log,
+	}, nil
+}
+
+func loadConfig(configFile string) (*RancherBootstrapConfig, error) {
+	config := &RancherBootstrapConfig{}
+	if err := decodeConfig(config, configFile); err != nil {
+		return nil, err
+	}
+
+	if config.Server == nil || config.Server.URL == "" {
+		return nil, fmt.Errorf("No server url in config: %s", configFile)
+	}
+
+	return config, nil
+}
+
+// decodeConfig reads configFile into config. Sections already in config are
+// merged key by key, an entry under a key replaces the one there.
+func decodeConfig(config *RancherBootstrapConfig, configFile string) error {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return fmt.Errorf("File does not exist: %s\n%s", configFile, err)
 	}
+	defer file.Close()
+
+	decoder := candiedyaml.NewDecoder(file)
+	if err = decoder.Decode(&config); err != nil {
+		return fmt.Errorf("Could not parse config: %s\n%s", configFile, err)
+	}
+	return nil
+}
+
+// ReloadConfig replaces the config with the contents of configFile. The
+// server it points at can not change.
+func (r *RancherServer) ReloadConfig(configFile string) error {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	if config.Server.URL != r.config.Server.URL {
+		return fmt.Errorf("Server url can not change from %s to %s", r.config.Server.URL, config.Server.URL)
+	}
+
+	r.config = config
+	return nil
 }
 
 func setOptAdminKeys(opts *client.ClientOpts, keyFile string) error {
 	file, err := os.Open(keyFile)
 	if err != nil {
-		logrus.Warnf("Keys could not be opened\n %s", err.Error())
 		return err
 	}
 	defer file.Close()
@@ -61,7 +162,7 @@ func setOptAdminKeys(opts *client.ClientOpts, keyFile string) error {
 	keys := make(map[string]string)
 	decoder := candiedyaml.NewDecoder(file)
 	if err = decoder.Decode(&keys); err != nil {
-		logrus.Fatalf("Could not parse keys: %s", err.Error())
+		return fmt.Errorf("Could not parse keys in %s: %s", keyFile, err)
 	}
 
 	if accessKey, ok := keys["access_key"]; ok {
@@ -77,123 +178,195 @@ func setOptAdminKeys(opts *client.ClientOpts, keyFile string) error {
 
 func (r *RancherServer) ConfigureAuthBackend() error {
 	if r.config.LdapConfig == nil {
-		logrus.Warn("No Ldap configuration found")
+		r.log.Warn("No Ldap configuration found")
 		return nil
 	}
 
 	enabled, err := ldapconfigEnabled(r.client)
 	if enabled != true {
-		logrus.Infof("enabling Ldap config")
-		_, err = r.client.Ldapconfig.Create(r.config.LdapConfig)
+		r.log.Infof("enabling Ldap config")
+		if _, err = r.client.Ldapconfig.Create(r.config.LdapConfig); err == nil {
+			r.recordChange("", "ldapconfig", "create", r.config.LdapConfig.Server)
+		}
 	}
 
 	return err
 }
 
-func (r *RancherServer) ConfigureAccounts() error {
-	accounts, err := r.client.Account.List(&client.ListOpts{})
+func (r *RancherServer) ConfigureEnvironments() error {
+	for key, project := range r.config.Projects {
+		if err := r.configureEnvironment(key, project); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureEnvironment configures the project under key in the config.
+func (r *RancherServer) configureEnvironment(key string, project *Project) error {
+	existing, err := r.findProject(key, project)
 	if err != nil {
 		return err
 	}
 
-	for key, acct := range r.config.Accounts {
-		if !accountExists(accounts, acct) {
-			logrus.Infof("Adding Acct: %s", key)
-			if _, err := r.client.Account.Create(acct); err != nil {
-				return err
-			}
-		}
+	if project.State == "Purged" {
+		return r.removeProject(key, existing)
 	}
-	return nil
+
+	return r.addProject(key, existing, project)
 }
 
-func accountExists(collection *client.AccountCollection, account *client.Account) bool {
-	exists := false
-	for _, acct := range collection.Data {
-		if account.ExternalId == acct.ExternalId {
-			exists = true
+func (r *RancherServer) ConfigureEnvironmentAccess() error {
+	for projectName, newProjectMembers := range r.config.Memberships {
+		if err := r.configureEnvironmentAccess(projectName, newProjectMembers); err != nil {
+			return err
 		}
 	}
-	return exists
+	return nil
 }
 
-func (r *RancherServer) ConfigureEnvironments() error {
-	for _, project := range r.config.Projects {
-		if project.State == "Purged" {
-			prj, err := getProjectByName(project.Name, r.client)
-			if err != nil {
-				return err
-			}
-
-			if err := removeProject(prj, r.client); err != nil {
-				return err
-			}
-		} else {
-			if err := addProject(project, r.client); err != nil {
-				return err
-			}
+func (r *RancherServer) configureEnvironmentAccess(projectName string, newProjectMembers map[string]*client.Identity) error {
+	existingProjectMembers, err := r.getExistingProjectMembers(projectName)
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, member := range newProjectMembers {
+		newMember, err := r.getProjectMemberIdentity(member.Name, member.Role, r.client)
+		if err != nil {
+			return err
 		}
+		if projectMemberExists(existingProjectMembers, newMember) {
+			continue
+		}
+		existingProjectMembers = append(existingProjectMembers, newMember)
+		added++
+	}
+
+	if added == 0 {
+		return nil
+	}
+
+	if err = r.addEnvironmentMembers(projectName, existingProjectMembers); err != nil {
+		return err
 	}
+	r.recordChange(projectName, "projectmembers", "update", projectName)
 	return nil
 }
 
-func (r *RancherServer) ConfigureEnvironmentAccess() error {
-	for projectName, newProjectMembers := range r.config.Memberships {
-		existingProjectMembers, err := getExistingProjectMembers(projectName, r.client)
+func (r *RancherServer) addProject(key string, existing *client.Project, prj *Project) error {
+	if err := validateProject(&prj.Project); err != nil {
+		return err
+	}
+
+	if existing == nil {
+		r.log.Infof("Addingproject: %s", prj.Name)
+		owner := r.newOwnership()
+		marked := prj.Project
+		if prj.PublicDns != nil {
+			marked.PublicDns = *prj.PublicDns
+		}
+		marked.Description = owner.description(prj.Description)
+		marked.Data = owner.data(prj.Data)
+		created, err := r.client.Project.Create(&marked)
 		if err != nil {
 			return err
 		}
+		r.recordChange(prj.Name, "project", "create", prj.Name)
+		return r.state.set("project", key, created.Id)
+	}
 
-		for _, member := range newProjectMembers {
-			newMember, err := getProjectMemberIdentity(member.Name, member.Role, r.client)
-			if err != nil {
-				return err
-			}
-			existingProjectMembers = append(existingProjectMembers, newMember)
-		}
+	if err := r.state.set("project", key, existing.Id); err != nil {
+		return err
+	}
+	return r.updateProject(existing, prj)
+}
 
-		if err = addEnvironmentMembers(projectName, existingProjectMembers, r.client); err != nil {
-			return err
+func (r *RancherServer) updateProject(existing *client.Project, prj *Project) error {
+	if projectOrchestration(existing) != projectOrchestration(&prj.Project) {
+		return fmt.Errorf("Can not change orchestration of project %s from %s to %s", prj.Name, projectOrchestration(existing), projectOrchestration(&prj.Project))
+	}
+
+	updates := map[string]interface{}{}
+	if existing.Name != prj.Name {
+		r.log.Infof("Renaming project %s to: %s", existing.Name, prj.Name)
+		updates["name"] = prj.Name
+	}
+
+	if prj.PublicDns != nil && existing.PublicDns != *prj.PublicDns {
+		updates["publicDns"] = *prj.PublicDns
+	}
+
+	if prj.Description != "" && unmarkedDescription(existing.Description) != prj.Description {
+		updates["description"] = markedDescription(existing.Description, prj.Description)
+	}
+
+	if prj.ServicesPortRange != nil && !servicesPortRangeEqual(existing.ServicesPortRange, prj.ServicesPortRange) {
+		updates["servicesPortRange"] = &client.ServicesPortRange{
+			StartPort: prj.ServicesPortRange.StartPort,
+			EndPort:   prj.ServicesPortRange.EndPort,
 		}
 	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	r.log.Infof("Updating project: %s", prj.Name)
+	r.checkManaged("project", existing.Name, existing.Description, existing.Data)
+	if _, err := r.client.Project.Update(existing, updates); err != nil {
+		return err
+	}
+	r.recordChange(prj.Name, "project", "update", prj.Name)
 	return nil
 }
 
-func projectExists(prj *client.Project, rClient *client.RancherClient) bool {
-	exists := false
-
-	projects, err := rClient.Project.List(&client.ListOpts{})
-	if err != nil {
-		logrus.Fatalf("Could not list projects")
+func validateProject(prj *client.Project) error {
+	if prj.Kubernetes && prj.Swarm {
+		return fmt.Errorf("Project %s can not enable both kubernetes and swarm", prj.Name)
 	}
 
-	for _, project := range projects.Data {
-		if project.Name == prj.Name {
-			exists = true
+	if portRange := prj.ServicesPortRange; portRange != nil {
+		if portRange.StartPort < 1 || portRange.EndPort > 65535 {
+			return fmt.Errorf("Project %s services_port_range must be within 1-65535, got %d-%d", prj.Name, portRange.StartPort, portRange.EndPort)
+		}
+		if portRange.StartPort >= portRange.EndPort {
+			return fmt.Errorf("Project %s services_port_range start_port must be lower than end_port, got %d-%d", prj.Name, portRange.StartPort, portRange.EndPort)
 		}
 	}
 
-	return exists
+	return nil
 }
-func addProject(prj *client.Project, rClient *client.RancherClient) error {
-	if !projectExists(prj, rClient) {
-		logrus.Infof("Addingproject: %s", prj.Name)
-		_, err := rClient.Project.Create(prj)
-		return err
+
+func projectOrchestration(prj *client.Project) string {
+	switch {
+	case prj.Kubernetes:
+		return "kubernetes"
+	case prj.Swarm:
+		return "swarm"
 	}
+	return "cattle"
+}
 
-	return nil
+func servicesPortRangeEqual(a *client.ServicesPortRange, b *client.ServicesPortRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.StartPort == b.StartPort && a.EndPort == b.EndPort
 }
 
-func removeProject(project *client.Project, rClient *client.RancherClient) error {
-	if projectExists(project, rClient) {
-		logrus.Infof("Removing project: %s", project.Name)
-		if err := rClient.Project.Delete(project); err != nil {
-			logrus.Fatalf("Error removing project: %s\n%s", project.Name, err)
+func (r *RancherServer) removeProject(key string, project *client.Project) error {
+	if project != nil {
+		r.log.Infof("Removing project: %s", project.Name)
+		r.checkManaged("project", project.Name, project.Description, project.Data)
+		if err := r.client.Project.Delete(project); err != nil {
+			return fmt.Errorf("Error removing project: %s\n%s", project.Name, err)
 		}
+		r.recordChange(project.Name, "project", "delete", project.Name)
 	}
 
-	return nil
+	return r.state.remove("project", key)
 }
 
 func generateAndSetAdminApiKeys(rClient *client.RancherClient, keyFile string) (*client.ApiKey, error) {
@@ -210,29 +383,24 @@ func generateAndSetAdminApiKeys(rClient *client.RancherClient, keyFile string) (
 
 	fileToWrite, err := os.Create(keyFile)
 	if err != nil {
-		logrus.Fatalf("Could not write out keys: %s", err)
+		return apiKey, fmt.Errorf("Could not write out keys: %s", err)
 	}
+	defer fileToWrite.Close()
 
 	encoder := candiedyaml.NewEncoder(fileToWrite)
-	err = encoder.Encode(keyDataOut)
-	if err != nil {
-		logrus.Fatalf("Failed to encode keys: %s", err)
+	if err = encoder.Encode(keyDataOut); err != nil {
+		return apiKey, fmt.Errorf("Failed to encode keys: %s", err)
 	}
 
-	return apiKey, err
+	return apiKey, nil
 }
 
-func generateProjectApiKeys(rClient *client.RancherClient, project *client.Project) (*client.ApiKey, error) {
-	logrus.Infof("Creating key for: %s", project.Id)
-	apiKey, err := rClient.ApiKey.Create(&client.ApiKey{
-		AccountId: project.Id,
-	})
-	if err != nil {
-		return apiKey, err
-	}
-
-	return apiKey, WaitFor(rClient, &apiKey.Resource, apiKey, func() string {
-		return apiKey.Transitioning
+func createProjectApiKey(rClient *client.RancherClient, project *client.Project, log *logrus.Entry) (*client.ApiKey, error) {
+	log.Infof("Creating key for: %s", project.Id)
+	return rClient.ApiKey.Create(&client.ApiKey{
+		AccountId:   project.Id,
+		Name:        projectKeyName,
+		Description: projectKeyDescription,
 	})
 }
 
@@ -0,0 +1,230 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudnautique/rbs-sandbox/rancher/ranchertest"
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(ioutil.Discard)
+	lockSettleDelay = 0
+	lockPollInterval = 10 * time.Millisecond
+	waitPollInterval = time.Millisecond
+	stackHealthPollInterval = 10 * time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+func testLog() *logrus.Entry {
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// testServer is a RancherServer connected to a fake server of its own.
+type testServer struct {
+	*RancherServer
+	fake *ranchertest.Server
+	dir  string
+}
+
+// newTestServer starts a fake server and connects to it with config, whose
+// server url is filled in.
+func newTestServer(t *testing.T, config *RancherBootstrapConfig) *testServer {
+	dir, err := ioutil.TempDir("", "rbs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{fake: ranchertest.NewServer(), dir: dir}
+	s.RancherServer = s.connect(t, config)
+	return s
+}
+
+// connect connects another RancherServer to the same fake server, like a
+// second run of rbs would.
+func (s *testServer) connect(t *testing.T, config *RancherBootstrapConfig) *RancherServer {
+	config.Server = &RancherServerConfig{URL: s.fake.URL}
+	r, err := newRancherServer(config, "config.yml", filepath.Join(s.dir, "keys.yml"), testLog())
+	if err != nil {
+		t.Fatalf("Could not connect to the fake server: %s", err)
+	}
+	return r
+}
+
+func (s *testServer) Close() {
+	s.RancherServer.Close()
+	s.fake.Close()
+	os.RemoveAll(s.dir)
+}
+
+// apply runs the config and fails the test if the run fails.
+func (s *testServer) apply(t *testing.T) *RunStatus {
+	status := s.ApplyOnce()
+	if !status.Success {
+		t.Fatalf("Run failed: %s", status.Error)
+	}
+	return status
+}
+
+func (s *testServer) projects() []client.Project {
+	projects := []client.Project{}
+	s.fake.List("project", &projects)
+	return projects
+}
+
+func TestApplyCreatesProjects(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev", Description: "Development"}},
+		},
+	})
+	defer s.Close()
+
+	if status := s.apply(t); status.DriftCount != 1 {
+		t.Fatalf("Expected 1 change, got %v", status.Changes)
+	}
+
+	projects := s.projects()
+	if len(projects) != 1 || projects[0].Name != "dev" {
+		t.Fatalf("Expected the project dev, got %#v", projects)
+	}
+	if !strings.HasPrefix(projects[0].Description, "Development [Managed by rbs from config.yml") {
+		t.Errorf("Project not marked in its description: %s", projects[0].Description)
+	}
+	if !isManaged(projects[0].Description, projects[0].Data) {
+		t.Errorf("Project not managed: %#v", projects[0])
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+}
+
+func TestApplyUpdatesProjects(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev", Description: "Development"}},
+		},
+	})
+	defer s.Close()
+	s.apply(t)
+
+	s.config.Projects["dev"].Description = "Testing"
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected an update, got %v", status.Changes)
+	}
+
+	project := s.projects()[0]
+	if unmarkedDescription(project.Description) != "Testing" || !isManaged(project.Description, project.Data) {
+		t.Fatalf("Expected the new description with the marker, got %s", project.Description)
+	}
+}
+
+func TestApplyKeepsUnsetPublicDns(t *testing.T) {
+	file, err := ioutil.TempFile("", "rbs-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("projects:\n  dev:\n    name: dev\n  qa:\n    name: qa\n    public_dns: false\n")
+	file.Close()
+
+	config := &RancherBootstrapConfig{}
+	if err := decodeConfig(config, file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if config.Projects["dev"].PublicDns != nil || config.Projects["qa"].PublicDns == nil {
+		t.Fatalf("Expected public_dns set for qa only, got %#v", config.Projects)
+	}
+
+	s := newTestServer(t, config)
+	defer s.Close()
+	s.fake.Add("project", &client.Project{Name: "dev", PublicDns: true})
+	s.fake.Add("project", &client.Project{Name: "qa", PublicDns: true})
+
+	status := s.apply(t)
+	if status.DriftCount != 1 || status.Changes[0].Name != "qa" {
+		t.Fatalf("Expected only qa to change, got %v", status.Changes)
+	}
+	for _, project := range s.projects() {
+		if project.PublicDns != (project.Name == "dev") {
+			t.Errorf("Unexpected public DNS of %s: %v", project.Name, project.PublicDns)
+		}
+	}
+}
+
+func TestApplyRenamesTrackedProjects(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "development"}},
+		},
+	})
+	defer s.Close()
+
+	id := s.fake.Add("project", &client.Project{Name: "dev"})
+	s.state = newMemoryState()
+	s.state.set("project", "dev", id)
+
+	s.apply(t)
+
+	projects := s.projects()
+	if len(projects) != 1 || projects[0].Id != id || projects[0].Name != "development" {
+		t.Fatalf("Expected %s renamed, got %#v", id, projects)
+	}
+}
+
+func TestApplyRemovesPurgedProjects(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"old": {Project: client.Project{Name: "old", State: "Purged"}},
+		},
+	})
+	defer s.Close()
+	s.fake.Add("project", &client.Project{Name: "old"})
+
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "delete" {
+		t.Fatalf("Expected a delete, got %v", status.Changes)
+	}
+	if projects := s.projects(); len(projects) != 0 {
+		t.Fatalf("Project not removed: %#v", projects)
+	}
+}
+
+func TestApplyKeepsOrchestration(t *testing.T) {
+	s := newTestServer(t, &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev", Kubernetes: true}},
+		},
+	})
+	defer s.Close()
+	s.fake.Add("project", &client.Project{Name: "dev"})
+
+	status := s.ApplyOnce()
+	if status.Success || !strings.Contains(status.Error, "Can not change orchestration of project dev from cattle to kubernetes") {
+		t.Fatalf("Expected the run to fail, got %#v", status)
+	}
+}
+
+func TestValidateProject(t *testing.T) {
+	for _, prj := range []*client.Project{
+		{Name: "both", Kubernetes: true, Swarm: true},
+		{Name: "low", ServicesPortRange: &client.ServicesPortRange{StartPort: 0, EndPort: 100}},
+		{Name: "high", ServicesPortRange: &client.ServicesPortRange{StartPort: 100, EndPort: 70000}},
+		{Name: "empty", ServicesPortRange: &client.ServicesPortRange{StartPort: 100, EndPort: 100}},
+	} {
+		if err := validateProject(prj); err == nil {
+			t.Errorf("Expected project %s to be invalid", prj.Name)
+		}
+	}
+
+	if err := validateProject(&client.Project{Name: "ok", ServicesPortRange: &client.ServicesPortRange{StartPort: 49153, EndPort: 65535}}); err != nil {
+		t.Errorf("Expected a valid project, got %s", err)
+	}
+}
@@ -0,0 +1,945 @@
+// Package ranchertest runs a fake Rancher server in process, for testing
+// code written against the go-rancher client without a real server.
+//
+// The fake serves the /v1 API from memory: schemas, CRUD on collections,
+// filters, paging, the common actions, resource.change events over
+// websockets and catalog templates. Every resource is active and never transitioning, so waits
+// return at once unless Transition says otherwise, and deleted resources are gone right away, as if purged.
+package ranchertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types are the resource types the fake serves, by schema id.
+var Types = []string{
+	"account",
+	"apiKey",
+	"auditLog",
+	"credential",
+	"environment",
+	"host",
+	"identity",
+	"ldapconfig",
+	"password",
+	"project",
+	"projectMember",
+	"pullTask",
+	"registrationToken",
+	"registry",
+	"registryCredential",
+	"service",
+	"setting",
+	"snapshot",
+	"volume",
+}
+
+// Resources of these types sit in a project. Created in the scope of a
+// project, their accountId is set to it, and listed there, only those of
+// the project are returned.
+var projectScoped = map[string]bool{
+	"environment":        true,
+	"host":               true,
+	"pullTask":           true,
+	"registrationToken":  true,
+	"registry":           true,
+	"registryCredential": true,
+	"service":            true,
+	"snapshot":           true,
+	"volume":             true,
+}
+
+// Fields of these types the server takes but never returns, like Rancher.
+// Get and List still show them, for tests to check what was sent.
+var writeOnly = map[string][]string{
+	"password":           {"secretValue"},
+	"registryCredential": {"secretValue"},
+}
+
+// Query parameters that are not filters.
+var listOptions = map[string]bool{
+	"limit":   true,
+	"marker":  true,
+	"sort":    true,
+	"order":   true,
+	"include": true,
+	"action":  true,
+}
+
+// ActionHandler carries out an action on resource, which it may change in
+// place. Its result is the response, nil for the resource itself.
+type ActionHandler func(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error)
+
+type failure struct {
+	method string
+	kind   string
+}
+
+// Server is a fake Rancher server. Its methods may be called while clients
+// talk to it.
+type Server struct {
+	// URL is the API url to point clients at, ending in /v1.
+	URL string
+
+	// PageSize makes collections come in pages of this many resources, to
+	// exercise paging. 0 returns everything at once.
+	PageSize int
+
+	server *httptest.Server
+
+	sync.Mutex
+	resources   map[string]map[string]map[string]interface{}
+	nextId      int
+	order       map[string]int
+	actions     map[string]map[string]ActionHandler
+	failures    map[failure]int
+	transitions map[string]string
+	upgrades    map[string]map[string]interface{}
+	templates   map[string]map[string]string
+	requests    []string
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	sync.Mutex
+	conn    *websocket.Conn
+	project string
+}
+
+// NewServer starts a fake server. It starts out with LDAP disabled and
+// nothing else, call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		resources:   map[string]map[string]map[string]interface{}{},
+		order:       map[string]int{},
+		actions:     map[string]map[string]ActionHandler{},
+		failures:    map[failure]int{},
+		transitions: map[string]string{},
+		upgrades:    map[string]map[string]interface{}{},
+		templates:   map[string]map[string]string{},
+		subscribers: map[*subscriber]bool{},
+	}
+	for _, kind := range Types {
+		s.resources[kind] = map[string]map[string]interface{}{}
+	}
+
+	for _, action := range []string{"activate", "restore"} {
+		s.HandleAction("", action, setState("active"))
+	}
+	s.HandleAction("", "deactivate", setState("inactive"))
+	s.HandleAction("", "remove", setState("removed"))
+	s.HandleAction("", "purge", purge)
+	s.HandleAction("project", "setmembers", setMembers)
+	s.HandleAction("password", "changesecret", changeSecret)
+	for _, kind := range []string{"environment", "service"} {
+		s.HandleAction(kind, "upgrade", upgrade)
+		s.HandleAction(kind, "finishupgrade", finishUpgrade)
+		s.HandleAction(kind, "rollback", rollback)
+		s.HandleAction(kind, "cancelupgrade", setState("canceled-upgrade"))
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/v1"
+
+	s.Add("ldapconfig", map[string]interface{}{
+		"name":    "ldapconfig",
+		"enabled": false,
+	})
+
+	return s
+}
+
+// Close stops the server and drops all event subscriptions.
+func (s *Server) Close() {
+	s.Lock()
+	for sub := range s.subscribers {
+		sub.conn.Close()
+	}
+	s.Unlock()
+
+	s.server.Close()
+}
+
+// HandleAction makes action on resources of kind run handler. An empty kind
+// applies to every kind without a handler of its own.
+func (s *Server) HandleAction(kind string, action string, handler ActionHandler) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.actions[kind] == nil {
+		s.actions[kind] = map[string]ActionHandler{}
+	}
+	s.actions[kind][action] = handler
+}
+
+// Fail makes requests with method on resources of kind fail with status,
+// which may be 0 to let them through again. An action is failed with the
+// method "action:<name>".
+func (s *Server) Fail(method string, kind string, status int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if status == 0 {
+		delete(s.failures, failure{method, kind})
+		return
+	}
+	s.failures[failure{method, kind}] = status
+}
+
+// Transition makes resources of kind report transitioning, such as "yes" or
+// "error", instead of "no". An empty transitioning reports "no" again.
+func (s *Server) Transition(kind string, transitioning string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if transitioning == "" {
+		delete(s.transitions, kind)
+		return
+	}
+	s.transitions[kind] = transitioning
+}
+
+// AddTemplate makes the catalog serve the template version id, such as
+// library:redis:1, with files.
+func (s *Server) AddTemplate(id string, files map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.templates[id] = files
+}
+
+// Add stores resource, anything that encodes to a JSON object such as a
+// client type, as a resource of kind and returns its id. The id of resource
+// is kept, if it has one. Nothing is published for it.
+func (s *Server) Add(kind string, resource interface{}) string {
+	data, err := toMap(resource)
+	if err != nil {
+		panic(err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.create(kind, data, "")
+}
+
+// Get decodes the resource of kind with id into output, which is usually a
+// pointer to a client type. It returns false if there is no such resource.
+func (s *Server) Get(kind string, id string, output interface{}) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	resource, ok := s.resources[kind][id]
+	if !ok {
+		return false
+	}
+	fromMap(s.render(kind, resource), output)
+	return true
+}
+
+// List decodes all resources of kind, in the order they were created, into
+// output, which is usually a pointer to a slice of a client type.
+func (s *Server) List(kind string, output interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	fromMap(s.list(kind, "", nil)["data"], output)
+}
+
+// Update changes fields of the resource of kind with id, like a change
+// made by hand, and publishes it.
+func (s *Server) Update(kind string, id string, updates map[string]interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	resource, ok := s.resources[kind][id]
+	if !ok {
+		panic(fmt.Sprintf("No %s %s", kind, id))
+	}
+	for key, value := range updates {
+		resource[key] = value
+	}
+	s.publish(kind, resource)
+}
+
+// Requests returns the requests served so far, as "METHOD path?query".
+func (s *Server) Requests() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+// Subscribers returns how many event subscriptions are open.
+func (s *Server) Subscribers() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.subscribers)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.RequestURI())
+	s.Unlock()
+
+	if strings.HasPrefix(req.URL.Path, "/v1-catalog/templates/") {
+		s.serveTemplate(w, strings.TrimPrefix(req.URL.Path, "/v1-catalog/templates/"))
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1"), "/")
+	if !strings.HasPrefix(req.URL.Path, "/v1") {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	parts := []string{}
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	// The url of a project doubles as the root of its scope, clients of
+	// the project find their schemas there.
+	project := ""
+	if len(parts) >= 2 && parts[0] == "projects" {
+		project = parts[1]
+		if len(parts) > 2 {
+			parts = parts[2:]
+		}
+	}
+	w.Header().Set("X-API-Schemas", s.baseURL(project)+"/schemas")
+
+	switch {
+	case len(parts) == 0:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"type": "apiVersion",
+			"links": map[string]string{
+				"schemas": s.baseURL(project) + "/schemas",
+			},
+		})
+	case parts[0] == "schemas":
+		writeJSON(w, http.StatusOK, s.schemas(project))
+	case parts[0] == "subscribe":
+		s.subscribe(w, req, project)
+	default:
+		kind, ok := kindOf(parts[0])
+		if !ok || len(parts) > 2 {
+			writeError(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		id := ""
+		if len(parts) == 2 {
+			id = parts[1]
+		}
+		s.serveResource(w, req, kind, id, project)
+	}
+}
+
+func (s *Server) serveTemplate(w http.ResponseWriter, id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	files, ok := s.templates[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"type":  "templateVersion",
+		"id":    id,
+		"files": files,
+	})
+}
+
+func (s *Server) serveResource(w http.ResponseWriter, req *http.Request, kind string, id string, project string) {
+	method := req.Method
+	action := req.URL.Query().Get("action")
+	if action != "" {
+		method = "action:" + action
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if status, ok := s.failures[failure{method, kind}]; ok {
+		writeError(w, status, "InjectedFailure")
+		return
+	}
+
+	var input map[string]interface{}
+	if req.Method == "POST" || req.Method == "PUT" {
+		body, _ := ioutil.ReadAll(req.Body)
+		input = map[string]interface{}{}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &input); err != nil {
+				writeError(w, statusUnprocessableEntity, "InvalidBodyContent")
+				return
+			}
+		}
+	}
+
+	if id == "" {
+		switch req.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, s.listPage(kind, project, req.URL))
+		case "POST":
+			writeJSON(w, http.StatusCreated, s.createResource(kind, input, project))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+
+	resource, ok := s.resources[kind][id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	switch {
+	case action != "":
+		handler := s.actions[kind][action]
+		if handler == nil {
+			handler = s.actions[""][action]
+		}
+		if handler == nil {
+			writeError(w, http.StatusNotFound, "ActionNotAvailable")
+			return
+		}
+		result, err := handler(s, resource, input)
+		if err != nil {
+			writeError(w, statusUnprocessableEntity, err.Error())
+			return
+		}
+		if _, stillThere := s.resources[kind][id]; stillThere {
+			s.publish(kind, resource)
+		}
+		if result == nil {
+			result = s.show(kind, resource)
+		}
+		writeJSON(w, http.StatusAccepted, result)
+	case req.Method == "GET":
+		writeJSON(w, http.StatusOK, s.show(kind, resource))
+	case req.Method == "PUT":
+		for key, value := range input {
+			if !readOnly(key) {
+				resource[key] = value
+			}
+		}
+		s.publish(kind, resource)
+		writeJSON(w, http.StatusOK, s.show(kind, resource))
+	case req.Method == "DELETE":
+		delete(s.resources[kind], id)
+		resource["state"] = "removed"
+		s.publish(kind, resource)
+		writeJSON(w, http.StatusOK, s.show(kind, resource))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// createResource handles a POST to a collection. LDAP config is a single
+// resource, posting it replaces it.
+func (s *Server) createResource(kind string, input map[string]interface{}, project string) map[string]interface{} {
+	if kind == "ldapconfig" {
+		for _, resource := range s.resources[kind] {
+			for key, value := range input {
+				if !readOnly(key) {
+					resource[key] = value
+				}
+			}
+			s.publish(kind, resource)
+			return s.show(kind, resource)
+		}
+	}
+
+	id := s.create(kind, input, project)
+	resource := s.resources[kind][id]
+	s.publish(kind, resource)
+	return s.show(kind, resource)
+}
+
+// create stores a new resource and returns its id, which is kept if input
+// has one. Fields rancher fills in are filled in the same way.
+func (s *Server) create(kind string, input map[string]interface{}, project string) string {
+	resource := map[string]interface{}{}
+	for key, value := range input {
+		if !readOnly(key) {
+			resource[key] = value
+		}
+	}
+
+	s.nextId++
+	id, _ := input["id"].(string)
+	switch {
+	case kind == "setting":
+		id, _ = resource["name"].(string)
+	case id == "":
+		id = fmt.Sprintf("1%s%d", idPrefix(kind), s.nextId)
+	}
+	resource["id"] = id
+
+	if project != "" && projectScoped[kind] {
+		resource["accountId"] = project
+	}
+	if _, ok := resource["state"]; !ok {
+		resource["state"] = "active"
+	}
+	if _, ok := resource["created"]; !ok {
+		resource["created"] = time.Now().UTC().Format(time.RFC3339)
+	}
+	resource["uuid"] = fmt.Sprintf("uuid-%s", id)
+
+	switch kind {
+	case "apiKey":
+		if _, ok := resource["publicValue"]; !ok {
+			resource["publicValue"] = fmt.Sprintf("KEY%d", s.nextId)
+		}
+		if _, ok := resource["secretValue"]; !ok {
+			resource["secretValue"] = fmt.Sprintf("secret%d", s.nextId)
+		}
+	case "registryCredential":
+		if _, ok := resource["kind"]; !ok {
+			resource["kind"] = "registryCredential"
+		}
+	case "pullTask":
+		// Pulls finish at once, done on every host of the project.
+		if _, ok := resource["status"]; !ok {
+			status := map[string]interface{}{}
+			for hostId, host := range s.resources["host"] {
+				if host["accountId"] == resource["accountId"] {
+					status[hostId] = "Done"
+				}
+			}
+			resource["status"] = status
+		}
+	case "registrationToken":
+		resource["token"] = fmt.Sprintf("TOKEN%d", s.nextId)
+		resource["command"] = fmt.Sprintf("sudo docker run -d --privileged -v /var/run/docker.sock:/var/run/docker.sock rancher/agent %s/scripts/TOKEN%d", s.URL, s.nextId)
+	case "account", "project":
+		if _, ok := resource["kind"]; !ok {
+			resource["kind"] = kind
+		}
+	}
+
+	s.resources[kind][id] = resource
+	s.order[kind+"/"+id] = s.nextId
+	return id
+}
+
+// byOrder sorts the ids of resources of kind in the order they were created.
+type byOrder struct {
+	kind  string
+	ids   []string
+	order map[string]int
+}
+
+func (b byOrder) Len() int      { return len(b.ids) }
+func (b byOrder) Swap(i, j int) { b.ids[i], b.ids[j] = b.ids[j], b.ids[i] }
+func (b byOrder) Less(i, j int) bool {
+	return b.order[b.kind+"/"+b.ids[i]] < b.order[b.kind+"/"+b.ids[j]]
+}
+
+// list returns the resources of kind in project matching filters, as a
+// collection.
+func (s *Server) list(kind string, project string, filters url.Values) map[string]interface{} {
+	ids := byOrder{kind: kind, order: s.order}
+	for id := range s.resources[kind] {
+		ids.ids = append(ids.ids, id)
+	}
+	sort.Sort(ids)
+
+	data := []interface{}{}
+	for _, id := range ids.ids {
+		resource := s.resources[kind][id]
+		if project != "" && projectScoped[kind] && resource["accountId"] != project {
+			continue
+		}
+		if project != "" && kind == "projectMember" && resource["projectId"] != project {
+			continue
+		}
+		if !matches(resource, filters) {
+			continue
+		}
+		data = append(data, s.render(kind, resource))
+	}
+
+	return map[string]interface{}{
+		"type":         "collection",
+		"resourceType": kind,
+		"data":         data,
+	}
+}
+
+// listPage serves a page of a collection, following marker in the query.
+func (s *Server) listPage(kind string, project string, requestURL *url.URL) map[string]interface{} {
+	query := requestURL.Query()
+	collection := s.list(kind, project, query)
+
+	data := collection["data"].([]interface{})
+	for _, resource := range data {
+		hideWriteOnly(kind, resource.(map[string]interface{}))
+	}
+	if s.PageSize <= 0 {
+		return collection
+	}
+
+	start, _ := strconv.Atoi(query.Get("marker"))
+	if start > len(data) {
+		start = len(data)
+	}
+	end := start + s.PageSize
+	if end >= len(data) {
+		end = len(data)
+	} else {
+		query.Set("marker", strconv.Itoa(end))
+		next := *requestURL
+		next.RawQuery = query.Encode()
+		collection["pagination"] = map[string]interface{}{
+			"next":    s.server.URL + next.RequestURI(),
+			"limit":   s.PageSize,
+			"partial": true,
+		}
+	}
+	collection["data"] = data[start:end]
+	return collection
+}
+
+// render returns resource as the API shows it, with its links and actions.
+func (s *Server) render(kind string, resource map[string]interface{}) map[string]interface{} {
+	id, _ := resource["id"].(string)
+	self := s.URL + "/" + pluralName(kind) + "/" + id
+
+	rendered := map[string]interface{}{}
+	for key, value := range resource {
+		rendered[key] = value
+	}
+	rendered["type"] = kind
+	rendered["transitioning"] = "no"
+	if transitioning, ok := s.transitions[kind]; ok {
+		rendered["transitioning"] = transitioning
+	}
+
+	links := map[string]string{"self": self}
+	if kind == "project" {
+		scope := s.baseURL(id)
+		links["projectMembers"] = scope + "/projectmembers"
+		links["registrationTokens"] = scope + "/registrationtokens"
+		links["registries"] = scope + "/registries"
+		links["credentials"] = scope + "/registrycredentials"
+	}
+	if kind == "environment" {
+		accountId, _ := resource["accountId"].(string)
+		links["services"] = s.baseURL(accountId) + "/services?environmentId=" + id
+	}
+	rendered["links"] = links
+
+	actions := map[string]string{}
+	for _, handlers := range []map[string]ActionHandler{s.actions[""], s.actions[kind]} {
+		for action := range handlers {
+			actions[action] = self + "?action=" + action
+		}
+	}
+	rendered["actions"] = actions
+
+	return rendered
+}
+
+// show returns resource as clients get it, rendered without the fields
+// that are write only.
+func (s *Server) show(kind string, resource map[string]interface{}) map[string]interface{} {
+	return hideWriteOnly(kind, s.render(kind, resource))
+}
+
+func hideWriteOnly(kind string, rendered map[string]interface{}) map[string]interface{} {
+	for _, field := range writeOnly[kind] {
+		delete(rendered, field)
+	}
+	return rendered
+}
+
+func (s *Server) schemas(project string) map[string]interface{} {
+	base := s.baseURL(project)
+	data := []interface{}{}
+	for _, kind := range Types {
+		data = append(data, map[string]interface{}{
+			"id":                kind,
+			"type":              "schema",
+			"pluralName":        pluralName(kind),
+			"collectionMethods": []string{"GET", "POST"},
+			"resourceMethods":   []string{"GET", "PUT", "DELETE"},
+			"links": map[string]string{
+				"self":       base + "/schemas/" + kind,
+				"collection": base + "/" + pluralName(kind),
+			},
+		})
+	}
+	return map[string]interface{}{
+		"type":         "collection",
+		"resourceType": "schema",
+		"data":         data,
+	}
+}
+
+func (s *Server) baseURL(project string) string {
+	if project == "" {
+		return s.URL
+	}
+	return s.URL + "/projects/" + project
+}
+
+var upgrader = websocket.Upgrader{}
+
+// subscribe streams resource.change events to a websocket client until it
+// goes away.
+func (s *Server) subscribe(w http.ResponseWriter, req *http.Request, project string) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+
+	sub := &subscriber{conn: conn, project: project}
+	s.Lock()
+	s.subscribers[sub] = true
+	s.Unlock()
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	s.Lock()
+	delete(s.subscribers, sub)
+	s.Unlock()
+	conn.Close()
+}
+
+// publish sends a resource.change event for resource to the subscriptions
+// it is visible to. The caller holds the lock.
+func (s *Server) publish(kind string, resource map[string]interface{}) {
+	event := map[string]interface{}{
+		"name":         "resource.change",
+		"resourceType": kind,
+		"resourceId":   resource["id"],
+		"data": map[string]interface{}{
+			"resource": s.show(kind, resource),
+		},
+	}
+
+	for sub := range s.subscribers {
+		if sub.project != "" && !inProject(resource, sub.project) {
+			continue
+		}
+		sub.Lock()
+		sub.conn.WriteJSON(event)
+		sub.Unlock()
+	}
+}
+
+// inProject tells whether resource is the project or belongs to it.
+func inProject(resource map[string]interface{}, project string) bool {
+	return resource["id"] == project || resource["accountId"] == project || resource["projectId"] == project
+}
+
+func setState(state string) ActionHandler {
+	return func(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+		resource["state"] = state
+		return nil, nil
+	}
+}
+
+func purge(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	if resource["state"] != "removed" {
+		return nil, fmt.Errorf("Only removed resources can be purged")
+	}
+	resource["state"] = "purged"
+	for kind, resources := range s.resources {
+		for id, other := range resources {
+			if other["id"] == resource["id"] {
+				delete(s.resources[kind], id)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// setMembers replaces the members of a project with those of the input.
+func setMembers(s *Server, project map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	for id, member := range s.resources["projectMember"] {
+		if member["projectId"] == project["id"] {
+			delete(s.resources["projectMember"], id)
+		}
+	}
+
+	members, _ := input["members"].([]interface{})
+	for _, member := range members {
+		fields, ok := member.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid member: %v", member)
+		}
+		fields["projectId"] = project["id"]
+		if _, ok := fields["name"]; !ok {
+			fields["name"] = fields["externalId"]
+		}
+		s.create("projectMember", fields, "")
+	}
+	return input, nil
+}
+
+// upgrade takes the fields of an upgrade, keeping the previous ones for a
+// rollback. In service upgrades they come as the launch config of the
+// strategy.
+func upgrade(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	previous := map[string]interface{}{}
+	for key, value := range resource {
+		previous[key] = value
+	}
+	id, _ := resource["id"].(string)
+	s.upgrades[id] = previous
+
+	for key, value := range input {
+		if strategy, ok := value.(map[string]interface{}); ok && key == "inServiceStrategy" {
+			resource["launchConfig"] = strategy["launchConfig"]
+			continue
+		}
+		if !readOnly(key) {
+			resource[key] = value
+		}
+	}
+	resource["state"] = "upgraded"
+	return nil, nil
+}
+
+func finishUpgrade(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	id, _ := resource["id"].(string)
+	delete(s.upgrades, id)
+	resource["state"] = "active"
+	return nil, nil
+}
+
+// rollback restores the fields a resource had before its upgrade.
+func rollback(s *Server, resource map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	id, _ := resource["id"].(string)
+	previous, ok := s.upgrades[id]
+	if !ok {
+		return nil, fmt.Errorf("Nothing to roll back")
+	}
+	delete(s.upgrades, id)
+
+	for key := range resource {
+		delete(resource, key)
+	}
+	for key, value := range previous {
+		resource[key] = value
+	}
+	resource["state"] = "active"
+	return nil, nil
+}
+
+func changeSecret(s *Server, password map[string]interface{}, input map[string]interface{}) (interface{}, error) {
+	password["secretValue"] = input["newSecret"]
+	return nil, nil
+}
+
+func matches(resource map[string]interface{}, filters url.Values) bool {
+	for key, values := range filters {
+		if listOptions[key] {
+			continue
+		}
+		if fmt.Sprint(resource[key]) != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func readOnly(key string) bool {
+	switch key {
+	case "id", "type", "links", "actions", "transitioning":
+		return true
+	}
+	return false
+}
+
+// kindOf returns the type of a collection name such as registrycredentials.
+func kindOf(plural string) (string, bool) {
+	for _, kind := range Types {
+		if pluralName(kind) == plural {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+func pluralName(kind string) string {
+	name := strings.ToLower(kind)
+	if strings.HasSuffix(name, "y") {
+		return strings.TrimSuffix(name, "y") + "ies"
+	}
+	return name + "s"
+}
+
+func idPrefix(kind string) string {
+	switch kind {
+	case "account", "project":
+		return "a"
+	case "apiKey", "password", "registryCredential", "credential":
+		return "c"
+	case "registry":
+		return "sp"
+	case "projectMember":
+		return "pm"
+	}
+	return "i"
+}
+
+func toMap(value interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	return result, json.Unmarshal(data, &result)
+}
+
+func fromMap(value interface{}, output interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, output); err != nil {
+		panic(err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// statusUnprocessableEntity is what Rancher answers invalid input with. The
+// http package only names it from Go 1.7 on.
+const statusUnprocessableEntity = 422
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]interface{}{
+		"type":   "error",
+		"status": status,
+		"code":   code,
+	})
+}
@@ -0,0 +1,276 @@
+package ranchertest
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/go-rancher/client"
+)
+
+// dropContentLength removes the malformed Content-Length header the vendored
+// client sets on creates and updates, as rbs does for its own requests.
+type dropContentLength struct {
+	next http.RoundTripper
+}
+
+func (t dropContentLength) RoundTrip(req *http.Request) (*http.Response, error) {
+	copied := *req
+	copied.Header = http.Header{}
+	for key, values := range req.Header {
+		if key != "Content-Length" {
+			copied.Header[key] = values
+		}
+	}
+	return t.next.RoundTrip(&copied)
+}
+
+func TestMain(m *testing.M) {
+	http.DefaultTransport = dropContentLength{next: http.DefaultTransport}
+	os.Exit(m.Run())
+}
+
+func newClient(t *testing.T, url string) *client.RancherClient {
+	rClient, err := client.NewRancherClient(&client.ClientOpts{Url: url})
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	return rClient
+}
+
+func TestCRUD(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	rClient := newClient(t, s.URL)
+
+	created, err := rClient.Project.Create(&client.Project{Name: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.State != "active" || created.Transitioning != "no" {
+		t.Fatalf("Unexpected project: %#v", created)
+	}
+
+	updated, err := rClient.Project.Update(created, map[string]interface{}{"description": "Development"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "dev" || updated.Description != "Development" {
+		t.Fatalf("Update lost fields: %#v", updated)
+	}
+
+	found, err := rClient.Project.ById(created.Id)
+	if err != nil || found == nil || found.Description != "Development" {
+		t.Fatalf("ById returned %#v, %v", found, err)
+	}
+
+	if err := rClient.Project.Delete(found); err != nil {
+		t.Fatal(err)
+	}
+	if found, err = rClient.Project.ById(created.Id); err != nil || found != nil {
+		t.Fatalf("Deleted project still there: %#v, %v", found, err)
+	}
+}
+
+func TestFiltersAndPages(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.PageSize = 2
+	for _, name := range []string{"a", "b", "c", "b"} {
+		s.Add("account", &client.Account{Name: name, Kind: "user"})
+	}
+	rClient := newClient(t, s.URL)
+
+	accounts, err := rClient.Account.List(&client.ListOpts{Filters: map[string]interface{}{"name": "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts.Data) != 2 || accounts.Pagination != nil {
+		t.Fatalf("Expected both accounts called b on one page, got %#v", accounts)
+	}
+
+	accounts, err = rClient.Account.List(&client.ListOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts.Data) != 2 || accounts.Pagination == nil || accounts.Pagination.Next == "" {
+		t.Fatalf("Expected a first page of 2, got %#v", accounts)
+	}
+
+	next := &client.AccountCollection{}
+	link := client.Resource{Links: map[string]string{"next": accounts.Pagination.Next}}
+	if err := rClient.GetLink(link, "next", next); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Data) != 2 || next.Data[0].Name != "c" || next.Pagination != nil {
+		t.Fatalf("Unexpected last page: %#v", next)
+	}
+}
+
+func TestProjectScope(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	dev := s.Add("project", &client.Project{Name: "dev"})
+	prod := s.Add("project", &client.Project{Name: "prod"})
+	s.Add("registry", &client.Registry{ServerAddress: "prod.example.com", AccountId: prod})
+
+	devClient := newClient(t, s.URL+"/projects/"+dev)
+	if _, err := devClient.Registry.Create(&client.Registry{ServerAddress: "dev.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	registries, err := devClient.Registry.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registries.Data) != 1 || registries.Data[0].AccountId != dev {
+		t.Fatalf("Expected only the registry of dev, got %#v", registries.Data)
+	}
+
+	project := &client.Project{}
+	s.Get("project", prod, project)
+	linked := &client.RegistryCollection{}
+	if err := devClient.GetLink(project.Resource, "registries", linked); err != nil {
+		t.Fatal(err)
+	}
+	if len(linked.Data) != 1 || linked.Data[0].ServerAddress != "prod.example.com" {
+		t.Fatalf("Expected the registry of prod, got %#v", linked.Data)
+	}
+}
+
+func TestActions(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	rClient := newClient(t, s.URL)
+
+	project, err := rClient.Project.Create(&client.Project{Name: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rClient.Project.ActionSetmembers(project, &client.SetProjectMembersInput{
+		Members: []client.ProjectMember{{ExternalId: "cn=ops", ExternalIdType: "ldap_group", Role: "owner"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	members := &client.ProjectMemberCollection{}
+	if err := rClient.GetLink(project.Resource, "projectMembers", members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members.Data) != 1 || members.Data[0].Role != "owner" {
+		t.Fatalf("Unexpected members: %#v", members.Data)
+	}
+
+	account, err := rClient.Account.Create(&client.Account{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		action func(*client.Account) (*client.Account, error)
+		state  string
+	}{
+		{rClient.Account.ActionDeactivate, "inactive"},
+		{rClient.Account.ActionRemove, "removed"},
+		{rClient.Account.ActionPurge, "purged"},
+	} {
+		if account, err = step.action(account); err != nil {
+			t.Fatal(err)
+		}
+		if account.State != step.state {
+			t.Fatalf("Expected %s, got %s", step.state, account.State)
+		}
+	}
+	if s.Get("account", account.Id, &client.Account{}) {
+		t.Fatalf("Purged account still there")
+	}
+
+	key, err := rClient.ApiKey.Create(&client.ApiKey{AccountId: "1a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PublicValue == "" || key.SecretValue == "" {
+		t.Fatalf("Key without values: %#v", key)
+	}
+}
+
+func TestWriteOnly(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	rClient := newClient(t, s.URL)
+
+	created, err := rClient.RegistryCredential.Create(&client.RegistryCredential{PublicValue: "ci", SecretValue: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := rClient.RegistryCredential.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.SecretValue != "" || len(listed.Data) != 1 || listed.Data[0].SecretValue != "" {
+		t.Fatalf("Secret returned: %#v, %#v", created, listed.Data)
+	}
+
+	stored := &client.RegistryCredential{}
+	if !s.Get("registryCredential", created.Id, stored) || stored.SecretValue != "s3cret" {
+		t.Fatalf("Secret not stored: %#v", stored)
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	rClient := newClient(t, s.URL)
+
+	s.Fail("POST", "project", http.StatusInternalServerError)
+	if _, err := rClient.Project.Create(&client.Project{Name: "dev"}); err == nil {
+		t.Fatalf("Expected the create to fail")
+	}
+
+	s.Fail("POST", "project", 0)
+	if _, err := rClient.Project.Create(&client.Project{Name: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, request := range s.Requests() {
+		found = found || strings.HasPrefix(request, "POST /v1/projects")
+	}
+	if !found {
+		t.Fatalf("Requests not recorded: %v", s.Requests())
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	dev := s.Add("project", &client.Project{Name: "dev"})
+	prod := s.Add("project", &client.Project{Name: "prod"})
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/projects/" + dev + "/subscribe?eventNames=resource.change"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for s.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Update("project", prod, map[string]interface{}{"description": "not for dev"})
+	s.Update("project", dev, map[string]interface{}{"description": "for dev"})
+
+	event := struct {
+		Name         string `json:"name"`
+		ResourceType string `json:"resourceType"`
+		ResourceId   string `json:"resourceId"`
+	}{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "resource.change" || event.ResourceType != "project" || event.ResourceId != dev {
+		t.Fatalf("Unexpected event: %#v", event)
+	}
+}
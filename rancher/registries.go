@@ -1,124 +1,203 @@
 package rancher
 
-import (
-	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/client"
-)
+import "github.com/rancher/go-rancher/client"
 
 func (r *RancherServer) ConfigureRegistries() error {
 	for projectName, configProjectRegistries := range r.config.Registries {
-
-		logrus.Infof("Configuring registries for project: %s", projectName)
-		project, err := getProjectByName(projectName, r.client)
-		if err != nil {
+		if err := r.configureProjectRegistries(projectName, configProjectRegistries); err != nil {
 			return err
 		}
+	}
 
-		projectKeys, err := generateProjectApiKeys(r.client, project)
-		if err != nil {
-			logrus.Errorf("Unable to create project keys")
-			return err
-		}
-		defer r.client.ApiKey.Delete(projectKeys)
+	return nil
+}
 
-		projectClientOpts := &client.ClientOpts{
-			Url:       r.config.Server.URL + "/projects/" + project.Id,
-			AccessKey: projectKeys.PublicValue,
-			SecretKey: projectKeys.SecretValue,
-		}
+func (r *RancherServer) configureProjectRegistries(projectName string, configProjectRegistries []client.Registry) error {
+	r.log.Infof("Configuring registries for project: %s", projectName)
+	project, err := r.getProjectByName(projectName)
+	if err != nil {
+		return err
+	}
 
-		projectClient, err := getRancherClient(projectClientOpts)
-		if err != nil {
-			logrus.Errorf("Could not get client")
-			return err
-		}
-		logrus.Debugf("Created client for project: %s", projectName)
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return err
+	}
 
-		projectRegistries, err := getProjectRegistries(projectClient, project)
-		if err != nil {
-			logrus.Errorf("Unable to get registry list for project: %s", projectName)
-			return err
+	projectRegistries, err := r.inventory.Registries(projectClient, project)
+	if err != nil {
+		r.log.Errorf("Unable to get registry list for project: %s", projectName)
+		return err
+	}
+
+	for _, registry := range configProjectRegistries {
+		if !r.selected("registry", registry.ServerAddress) {
+			continue
 		}
 
-		for _, registry := range configProjectRegistries {
-			registry.AccountId = project.Id
-			registryExists := registryExists(projectRegistries, registry)
+		registry.AccountId = project.Id
+		registryExists := registryExists(*projectRegistries, registry)
 
-			if registry.State == "Purged" && registryExists {
-				logrus.Infof("Removing registry: %s", registry.ServerAddress)
+		if registry.State == "Purged" && registryExists {
+			r.log.Infof("Removing registry: %s", registry.ServerAddress)
 
-				registry = getExistingRegistry(projectRegistries, registry)
-				err = deleteRegistry(registry, projectClient)
-			} else if !registryExists && registry.State != "Purged" {
-				logrus.Infof("Adding registry: %s", registry.ServerAddress)
+			registry = getExistingRegistry(*projectRegistries, registry)
+			r.checkManaged("registry", registry.ServerAddress, registry.Description, registry.Data)
+			if err := r.deleteRegistry(registry, projectClient); err != nil {
+				return err
+			}
+			r.recordChange(projectName, "registry", "delete", registry.ServerAddress)
+		} else if !registryExists && registry.State != "Purged" {
+			r.log.Infof("Adding registry: %s", registry.ServerAddress)
+
+			owner := r.newOwnership()
+			registry.Description = owner.description(registry.Description)
+			registry.Data = owner.data(registry.Data)
+			createdReg, err := addRegistry(registry, projectClient)
+			if err != nil {
+				return err
+			}
 
-				createdReg, err := addRegistry(registry, projectClient)
-				if err != nil {
+			registry = *createdReg
+			r.recordChange(projectName, "registry", "create", registry.ServerAddress)
+			if credentials, ok := r.config.RegistryCredentials[project.Name][registry.ServerAddress]; ok {
+				r.log.Infof("Configuring credentials for: %s", registry.ServerAddress)
+				if err := r.ConfigureRegistryCredentials(projectClient, registry, project, credentials); err != nil {
 					return err
 				}
+			}
+		} else if registryExists {
+			r.log.Infof("Registry: %s exists", registry.ServerAddress)
+			registry = getExistingRegistry(*projectRegistries, registry)
 
-				registry = *createdReg
-				if credentials, ok := r.config.RegistryCredentials[project.Name][registry.ServerAddress]; ok {
-					logrus.Infof("Configuring credentials for: %s", registry.ServerAddress)
-					ConfigureRegistryCredentials(projectClient, registry, project, credentials)
-				}
-			} else if registryExists {
-				logrus.Infof("Registry: %s exists", registry.ServerAddress)
-				registry = getExistingRegistry(projectRegistries, registry)
-
-				if credentials, ok := r.config.RegistryCredentials[project.Name][registry.ServerAddress]; ok {
-					logrus.Infof("Configuring credentials for: %s", registry.ServerAddress)
-					ConfigureRegistryCredentials(projectClient, registry, project, credentials)
+			if credentials, ok := r.config.RegistryCredentials[project.Name][registry.ServerAddress]; ok {
+				r.log.Infof("Configuring credentials for: %s", registry.ServerAddress)
+				if err := r.ConfigureRegistryCredentials(projectClient, registry, project, credentials); err != nil {
+					return err
 				}
-			} else {
-				logrus.Infof("Registry: %s does not exist", registry.ServerAddress)
 			}
+		} else {
+			r.log.Infof("Registry: %s does not exist", registry.ServerAddress)
 		}
-
 	}
 
 	return nil
 }
 
-func ConfigureRegistryCredentials(rClient *client.RancherClient, registry client.Registry, project *client.Project, configCredentials []*client.RegistryCredential) error {
-	existingCredentials, err := getRegistryCredentials(rClient, project)
+func (r *RancherServer) ConfigureRegistryCredentials(rClient *client.RancherClient, registry client.Registry, project *client.Project, configCredentials []*RegistryCredential) error {
+	existingCredentials, err := r.inventory.RegistryCredentials(rClient, project)
 	if err != nil {
 		return err
 	}
 	for _, credential := range configCredentials {
-		credential.RegistryId = registry.Id
-		if !registryCredentialExists(existingCredentials, credential) {
-			if _, err := rClient.RegistryCredential.Create(credential); err != nil {
+		existing := getExistingRegistryCredential(*existingCredentials, registry, credential)
+
+		if credential.State == "Purged" {
+			if existing != nil {
+				r.log.Infof("Removing credentials for: %s user: %s", registry.ServerAddress, credential.PublicValue)
+				r.checkManaged("registry credential", registry.ServerAddress+"/"+credential.PublicValue, existing.Description, existing.Data)
+				if err := deleteRegistryCredential(existing, rClient); err != nil {
+					return err
+				}
+				r.recordChange(project.Name, "registrycredential", "delete", registry.ServerAddress+"/"+credential.PublicValue)
+			}
+			continue
+		}
+
+		secret, err := resolveSecret(credential.SecretValue)
+		if err != nil {
+			return err
+		}
+
+		if credential.Verify && (existing == nil || registryCredentialChanged(existing, credential, r.secretHashKey(), secret)) {
+			r.log.Infof("Verifying credentials for: %s user: %s", registry.ServerAddress, credential.PublicValue)
+			if err := verifyRegistryCredential(registry.ServerAddress, credential.PublicValue, secret); err != nil {
 				return err
 			}
 		}
+
+		if existing == nil {
+			r.log.Infof("Adding credentials for: %s user: %s", registry.ServerAddress, credential.PublicValue)
+			owner := r.newOwnership()
+			data, err := withSecretHash(owner.data(nil), r.secretHashKey(), secret)
+			if err != nil {
+				return err
+			}
+			if _, err := rClient.RegistryCredential.Create(&client.RegistryCredential{
+				RegistryId:  registry.Id,
+				Name:        credential.Name,
+				Description: owner.description(credential.Description),
+				Data:        data,
+				Email:       credential.Email,
+				PublicValue: credential.PublicValue,
+				SecretValue: secret,
+			}); err != nil {
+				return err
+			}
+			r.recordChange(project.Name, "registrycredential", "create", registry.ServerAddress+"/"+credential.PublicValue)
+		} else if registryCredentialChanged(existing, credential, r.secretHashKey(), secret) {
+			r.log.Infof("Updating credentials for: %s user: %s", registry.ServerAddress, credential.PublicValue)
+			r.checkManaged("registry credential", registry.ServerAddress+"/"+credential.PublicValue, existing.Description, existing.Data)
+			data, err := withSecretHash(existing.Data, r.secretHashKey(), secret)
+			if err != nil {
+				return err
+			}
+			if _, err := rClient.RegistryCredential.Update(existing, map[string]interface{}{
+				"email":       credential.Email,
+				"secretValue": secret,
+				"data":        data,
+			}); err != nil {
+				return err
+			}
+			r.recordChange(project.Name, "registrycredential", "update", registry.ServerAddress+"/"+credential.PublicValue)
+		}
 	}
 	return nil
 }
 
-func registryCredentialExists(collection client.RegistryCredentialCollection, credential *client.RegistryCredential) bool {
-	exists := false
-	for _, cred := range collection.Data {
-		if cred.Email == credential.Email && cred.Kind == "registryCredential" {
-			exists = true
+// getExistingRegistryCredential matches credentials on registry and username.
+func getExistingRegistryCredential(collection client.RegistryCredentialCollection, registry client.Registry, credential *RegistryCredential) *client.RegistryCredential {
+	for i, cred := range collection.Data {
+		if cred.Kind != "registryCredential" || cred.State == "removed" || cred.State == "purged" {
+			continue
+		}
+		if cred.RegistryId == registry.Id && cred.PublicValue == credential.PublicValue {
+			return &collection.Data[i]
 		}
 	}
-	return exists
+	return nil
 }
 
-func getRegistryCredentials(rClient *client.RancherClient, project *client.Project) (client.RegistryCredentialCollection, error) {
-	var credentialsCollection client.RegistryCredentialCollection
-	err := rClient.GetLink(project.Resource, "credentials", &credentialsCollection)
-	return credentialsCollection, err
+// registryCredentialChanged reports whether the configured credential differs
+// from the server side one. Servers do not return secret values, so the
+// secret is compared to the hash rbs keeps in the credential's marker. A
+// credential without one gets the configured secret pushed once.
+func registryCredentialChanged(existing *client.RegistryCredential, credential *RegistryCredential, key []byte, secret string) bool {
+	if existing.Email != credential.Email {
+		return true
+	}
+	if existing.SecretValue != "" {
+		return existing.SecretValue != secret
+	}
+	return !secretMatches(existing.Data, key, secret)
 }
 
-func getProjectRegistries(rClient *client.RancherClient, project *client.Project) (client.RegistryCollection, error) {
-	logrus.Infof("Getting registries for: %s", project.Id)
-
-	var registries client.RegistryCollection
-	err := rClient.GetLink(project.Resource, "registries", &registries)
+func deleteRegistryCredential(credential *client.RegistryCredential, prjClient *client.RancherClient) error {
+	if credential.State == "active" {
+		if _, err := prjClient.RegistryCredential.ActionDeactivate(credential); err != nil {
+			return err
+		}
+		if err := WaitFor(prjClient, &credential.Resource, credential, func() string {
+			if credential.State == "active" {
+				return "yes"
+			}
+			return credential.Transitioning
+		}); err != nil {
+			return err
+		}
+	}
 
-	return registries, err
+	return prjClient.RegistryCredential.Delete(credential)
 }
 
 func registryExists(collection client.RegistryCollection, registry client.Registry) bool {
@@ -142,8 +221,8 @@ func getExistingRegistry(collection client.RegistryCollection, registry client.R
 	return returnRegistry
 }
 
-func deleteRegistry(registry client.Registry, prjClient *client.RancherClient) error {
-	logrus.Infof("deactivating: %#v", registry.Id)
+func (r *RancherServer) deleteRegistry(registry client.Registry, prjClient *client.RancherClient) error {
+	r.log.Infof("deactivating: %#v", registry.Id)
 
 	_, err := prjClient.Registry.ActionDeactivate(&registry)
 	if err != nil {
@@ -0,0 +1,177 @@
+package rancher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+func registryConfig() *RancherBootstrapConfig {
+	return &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Registries: map[string][]client.Registry{
+			"dev": {{ServerAddress: "registry.example.com"}},
+		},
+		RegistryCredentials: map[string]map[string][]*RegistryCredential{
+			"dev": {
+				"registry.example.com": {{
+					RegistryCredential: client.RegistryCredential{
+						Email:       "ci@example.com",
+						PublicValue: "ci",
+						SecretValue: "s3cret",
+					},
+				}},
+			},
+		},
+	}
+}
+
+func (s *testServer) registries() ([]client.Registry, []client.RegistryCredential) {
+	registries := []client.Registry{}
+	credentials := []client.RegistryCredential{}
+	s.fake.List("registry", &registries)
+	s.fake.List("registryCredential", &credentials)
+	return registries, credentials
+}
+
+func TestApplyCreatesRegistries(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+
+	s.apply(t)
+
+	project := s.projects()[0]
+	registries, credentials := s.registries()
+	if len(registries) != 1 || registries[0].ServerAddress != "registry.example.com" || registries[0].AccountId != project.Id {
+		t.Fatalf("Expected the registry in dev, got %#v", registries)
+	}
+	if !isManaged(registries[0].Description, registries[0].Data) {
+		t.Errorf("Registry not managed: %#v", registries[0])
+	}
+	if len(credentials) != 1 || credentials[0].RegistryId != registries[0].Id || credentials[0].SecretValue != "s3cret" {
+		t.Fatalf("Expected the credential of the registry, got %#v", credentials)
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+}
+
+func TestApplyUpdatesRegistryCredentials(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	s.apply(t)
+
+	credential := s.config.RegistryCredentials["dev"]["registry.example.com"][0]
+	credential.Email = "builds@example.com"
+	status := s.apply(t)
+	if status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected an update, got %v", status.Changes)
+	}
+	if _, credentials := s.registries(); len(credentials) != 1 || credentials[0].Email != "builds@example.com" {
+		t.Fatalf("Credential not updated: %#v", credentials)
+	}
+
+	credential.State = "Purged"
+	s.apply(t)
+	if _, credentials := s.registries(); len(credentials) != 0 {
+		t.Fatalf("Credential not removed: %#v", credentials)
+	}
+}
+
+func TestApplyRotatesRegistrySecrets(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	s.apply(t)
+
+	s.config.RegistryCredentials["dev"]["registry.example.com"][0].SecretValue = "n3w"
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected an update, got %v", status.Changes)
+	}
+	_, credentials := s.registries()
+	if credentials[0].SecretValue != "n3w" || !secretMatches(credentials[0].Data, s.secretHashKey(), "n3w") {
+		t.Fatalf("Secret not rotated: %#v", credentials[0])
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Run after the rotation changed %v", status.Changes)
+	}
+}
+
+func TestApplyRemovesPurgedRegistries(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+	s.apply(t)
+
+	s.config.Registries["dev"][0].State = "Purged"
+	s.apply(t)
+	if registries, _ := s.registries(); len(registries) != 0 {
+		t.Fatalf("Registry not removed: %#v", registries)
+	}
+}
+
+func TestApplyRemovesProjectKeys(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+
+	s.fake.Fail("POST", "registryCredential", http.StatusInternalServerError)
+	if status := s.ApplyOnce(); status.Success {
+		t.Fatalf("Expected the run to fail")
+	}
+
+	keys := []client.ApiKey{}
+	s.fake.List("apiKey", &keys)
+	for _, key := range keys {
+		if key.Name == projectKeyName {
+			t.Fatalf("Project key left behind: %#v", key)
+		}
+	}
+}
+
+func TestApplyRemovesKeysThatFailedToActivate(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+
+	s.fake.Transition("apiKey", "yes")
+	s.fake.Fail("GET", "apiKey", http.StatusInternalServerError)
+	if status := s.ApplyOnce(); status.Success {
+		t.Fatalf("Expected the run to fail")
+	}
+
+	keys := []client.ApiKey{}
+	s.fake.List("apiKey", &keys)
+	for _, key := range keys {
+		if key.Name == projectKeyName {
+			t.Fatalf("Project key left behind: %#v", key)
+		}
+	}
+}
+
+func TestProjectKeysLogToTheNode(t *testing.T) {
+	s := newTestServer(t, registryConfig())
+	defer s.Close()
+
+	out := &bytes.Buffer{}
+	logrus.SetOutput(out)
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetLevel(logrus.InfoLevel)
+	s.apply(t)
+
+	for _, message := range []string{"Creating key for", "Created client for project: dev"} {
+		found := false
+		for _, line := range strings.Split(out.String(), "\n") {
+			found = found || strings.Contains(line, message) && strings.Contains(line, "resource=\"registries:dev\"")
+		}
+		if !found {
+			t.Errorf("Expected %q logged by registries:dev, got:\n%s", message, out)
+		}
+	}
+}
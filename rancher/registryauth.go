@@ -0,0 +1,164 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// verifyRegistryCredential logs in to a Docker Registry v2 API with the given
+// username and secret. Both the basic and the bearer token auth flows are
+// supported.
+func verifyRegistryCredential(serverAddress string, username string, secret string) error {
+	baseURL := serverAddress
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "https://" + baseURL
+	}
+	pingURL := strings.TrimRight(baseURL, "/") + "/v2/"
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := registryGet(httpClient, pingURL, nil)
+	if err != nil {
+		return fmt.Errorf("Could not reach registry %s: %s", serverAddress, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("Unexpected response from registry %s: %s", serverAddress, resp.Status)
+	}
+
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "basic":
+		resp, err = registryGet(httpClient, pingURL, func(req *http.Request) {
+			req.SetBasicAuth(username, secret)
+		})
+	case "bearer":
+		var token string
+		token, err = getRegistryToken(httpClient, params, username, secret)
+		if err != nil {
+			return fmt.Errorf("Could not log in to registry %s as %s: %s", serverAddress, username, err)
+		}
+		resp, err = registryGet(httpClient, pingURL, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		})
+	default:
+		return fmt.Errorf("Unsupported auth challenge from registry %s: %q", serverAddress, resp.Header.Get("WWW-Authenticate"))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not reach registry %s: %s", serverAddress, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not log in to registry %s as %s: %s", serverAddress, username, resp.Status)
+	}
+	return nil
+}
+
+func getRegistryToken(httpClient *http.Client, params map[string]string, username string, secret string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("Bearer challenge without realm")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := params[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	resp, err := registryGet(httpClient, tokenURL.String(), func(req *http.Request) {
+		req.SetBasicAuth(username, secret)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token request was refused: %s", resp.Status)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	if tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return "", fmt.Errorf("Token response did not contain a token")
+}
+
+func registryGet(httpClient *http.Client, url string, setupRequest func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if setupRequest != nil {
+		setupRequest(req)
+	}
+	return httpClient.Do(req)
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth",service="registry"` into its lower cased
+// scheme and parameters.
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return scheme, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
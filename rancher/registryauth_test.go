@@ -0,0 +1,99 @@
+package rancher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// newRegistry starts a registry asking for basic auth, or for a token from
+// its /token endpoint with bearer.
+func newRegistry(scheme string) *httptest.Server {
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		switch {
+		case req.URL.Path == "/token":
+			if !ok || username != "ci" || password != "s3cret" || req.URL.Query().Get("service") != "registry" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+		case scheme == "basic" && ok && username == "ci" && password == "s3cret":
+		case scheme == "bearer" && req.Header.Get("Authorization") == "Bearer t0ken":
+		case scheme == "basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+registry.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	return registry
+}
+
+func TestVerifyRegistryCredential(t *testing.T) {
+	for _, scheme := range []string{"basic", "bearer"} {
+		registry := newRegistry(scheme)
+
+		if err := verifyRegistryCredential(registry.URL, "ci", "s3cret"); err != nil {
+			t.Errorf("Expected %s login to succeed, got %s", scheme, err)
+		}
+		if err := verifyRegistryCredential(registry.URL, "ci", "wrong"); err == nil {
+			t.Errorf("Expected %s login with a wrong secret to fail", scheme)
+		}
+
+		registry.Close()
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:app:pull,push"`)
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:app:pull,push",
+	}
+	if scheme != "bearer" || !reflect.DeepEqual(params, expected) {
+		t.Fatalf("Unexpected challenge: %s %#v", scheme, params)
+	}
+
+	if scheme, params := parseAuthChallenge("Basic"); scheme != "basic" || len(params) != 0 {
+		t.Fatalf("Unexpected challenge: %s %#v", scheme, params)
+	}
+}
+
+func TestApplyVerifiesCredentials(t *testing.T) {
+	registry := newRegistry("bearer")
+	defer registry.Close()
+
+	config := registryConfig()
+	config.Registries["dev"][0].ServerAddress = registry.URL
+	config.RegistryCredentials["dev"] = map[string][]*RegistryCredential{
+		registry.URL: {{
+			RegistryCredential: client.RegistryCredential{PublicValue: "ci", SecretValue: "wrong"},
+			Verify:             true,
+		}},
+	}
+	s := newTestServer(t, config)
+	defer s.Close()
+
+	status := s.ApplyOnce()
+	if status.Success || !strings.Contains(status.Error, "Could not log in to registry "+registry.URL+" as ci") {
+		t.Fatalf("Expected the run to fail verification, got %#v", status)
+	}
+	if _, credentials := s.registries(); len(credentials) != 0 {
+		t.Fatalf("Credential saved without passing verification: %#v", credentials)
+	}
+
+	config.RegistryCredentials["dev"][registry.URL][0].SecretValue = "s3cret"
+	s.apply(t)
+	if _, credentials := s.registries(); len(credentials) != 1 {
+		t.Fatalf("Expected the verified credential, got %#v", credentials)
+	}
+}
@@ -0,0 +1,31 @@
+package rancher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// resolveSecret returns the value a secret reference points at. References
+// take the form env:NAME or file:/path/to/secret; any other value is used as
+// is.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Secret environment variable is not set: %s", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Could not read secret file: %s\n%s", path, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return ref, nil
+}
@@ -0,0 +1,393 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const stackHealthTimeout = 10 * time.Minute
+
+// stackHealthPollInterval is how often the health of upgraded services is
+// checked.
+var stackHealthPollInterval = 2 * time.Second
+
+// stackService is a service with its health state, which the generated
+// client does not decode.
+type stackService struct {
+	client.Service
+
+	HealthState string `json:"healthState,omitempty"`
+}
+
+type stackServiceCollection struct {
+	client.Collection
+	Data []stackService `json:"data,omitempty"`
+}
+
+// ConfigureStacks creates the configured stacks and rolls out changes to
+// their compose files and service images.
+func (r *RancherServer) ConfigureStacks() error {
+	for projectName, stacks := range r.config.Stacks {
+		if err := r.configureProjectStacks(projectName, stacks); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureProjectStacks(projectName string, stacks map[string]*Stack) error {
+	r.log.Infof("Configuring stacks for project: %s", projectName)
+	project, err := r.getProjectByName(projectName)
+	if err != nil {
+		return err
+	}
+	if project.Id == "" {
+		return fmt.Errorf("Project %s does not exist", projectName)
+	}
+
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range stacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !r.selected("stack", name) {
+			continue
+		}
+		if err := r.configureStack(projectClient, projectName, name, stacks[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureStack(prjClient *client.RancherClient, projectName string, name string, stackConfig *Stack) error {
+	dockerCompose, err := resolveSecret(stackConfig.DockerCompose)
+	if err != nil {
+		return err
+	}
+	rancherCompose, err := resolveSecret(stackConfig.RancherCompose)
+	if err != nil {
+		return err
+	}
+
+	environment := map[string]interface{}{}
+	for key, value := range stackConfig.Environment {
+		if environment[key], err = resolveSecret(value); err != nil {
+			return err
+		}
+	}
+
+	stack, err := getStackByName(prjClient, name)
+	if err != nil {
+		return err
+	}
+
+	if stack == nil {
+		r.log.Infof("Creating stack: %s", name)
+		stack, err = prjClient.Environment.Create(&client.Environment{
+			Name:           name,
+			DockerCompose:  dockerCompose,
+			RancherCompose: rancherCompose,
+			Environment:    environment,
+			StartOnCreate:  true,
+		})
+		if err != nil {
+			return err
+		}
+		if err := waitForStack(prjClient, stack); err != nil {
+			return err
+		}
+		r.recordChange(projectName, "stack", "create", name)
+		return nil
+	}
+
+	if composeChanged(stack.DockerCompose, dockerCompose) || composeChanged(stack.RancherCompose, rancherCompose) || answersChanged(stack.Environment, environment) {
+		err = r.upgradeStack(prjClient, stack, &client.EnvironmentUpgrade{
+			DockerCompose:  dockerCompose,
+			RancherCompose: rancherCompose,
+			Environment:    environment,
+		}, stackConfig.Upgrade)
+		if err != nil {
+			return err
+		}
+		r.recordChange(projectName, "stack", "update", name)
+	}
+
+	serviceNames := []string{}
+	for serviceName := range stackConfig.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	for _, serviceName := range serviceNames {
+		service, err := getStackService(prjClient, stack, serviceName)
+		if err != nil {
+			return err
+		}
+		if service == nil {
+			return fmt.Errorf("Service %s does not exist in stack %s", serviceName, name)
+		}
+
+		image := stackConfig.Services[serviceName].Image
+		if image == "" || service.LaunchConfig == nil || service.LaunchConfig.ImageUuid == "docker:"+image {
+			continue
+		}
+
+		if err := r.upgradeService(prjClient, stack, service, image, stackConfig.Upgrade); err != nil {
+			return err
+		}
+		r.recordChange(projectName, "service", "update", name+"/"+serviceName)
+	}
+
+	return nil
+}
+
+// composeChanged compares compose files, ignoring line endings and the blank
+// space around them, which editors and the server do not keep alike.
+func composeChanged(existing string, compose string) bool {
+	normalize := func(text string) string {
+		return strings.TrimSpace(strings.Replace(text, "\r\n", "\n", -1))
+	}
+	return normalize(existing) != normalize(compose)
+}
+
+func getStackByName(prjClient *client.RancherClient, name string) (*client.Environment, error) {
+	stacks, err := prjClient.Environment.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"name": name,
+		},
+	})
+	if err == nil {
+		err = followPages(prjClient, stacks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, stack := range stacks.Data {
+		if stack.Name == name && stack.State != "removed" && stack.State != "purged" && stack.State != "removing" {
+			return &stacks.Data[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func getStackServices(prjClient *client.RancherClient, stack *client.Environment) ([]stackService, error) {
+	services := &stackServiceCollection{}
+	if err := listLink(prjClient, stack.Resource, "services", services); err != nil {
+		return nil, err
+	}
+	return services.Data, nil
+}
+
+func getStackService(prjClient *client.RancherClient, stack *client.Environment, name string) (*client.Service, error) {
+	services, err := getStackServices(prjClient, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, service := range services {
+		if service.Name == name {
+			return &services[i].Service, nil
+		}
+	}
+	return nil, nil
+}
+
+// upgradeStack upgrades a stack and finishes the upgrade once all of its
+// services are healthy. Stacks that do not settle are rolled back or have
+// their upgrade cancelled, depending on the strategy.
+func (r *RancherServer) upgradeStack(prjClient *client.RancherClient, stack *client.Environment, upgrade *client.EnvironmentUpgrade, strategy *UpgradeStrategy) error {
+	timeout, err := strategy.timeout()
+	if err != nil {
+		return err
+	}
+
+	r.log.Infof("Upgrading stack: %s", stack.Name)
+	stack, err = prjClient.Environment.ActionUpgrade(stack, upgrade)
+	if err != nil {
+		return err
+	}
+
+	if err = waitForStack(prjClient, stack); err == nil && stack.State != "upgraded" {
+		err = fmt.Errorf("Upgrade of stack %s ended in state %s: %s", stack.Name, stack.State, stack.TransitioningMessage)
+	}
+	if err == nil {
+		err = r.waitForServicesHealthy(prjClient, stack, nil, timeout)
+	}
+	if err != nil {
+		if revertErr := r.revertStackUpgrade(prjClient, stack, strategy); revertErr != nil {
+			r.log.Errorf("Could not revert upgrade of stack %s: %s", stack.Name, revertErr)
+		}
+		return err
+	}
+
+	r.log.Infof("Finishing upgrade of stack: %s", stack.Name)
+	stack, err = prjClient.Environment.ActionFinishupgrade(stack)
+	if err != nil {
+		return err
+	}
+	return waitForStack(prjClient, stack)
+}
+
+func (r *RancherServer) revertStackUpgrade(prjClient *client.RancherClient, stack *client.Environment, strategy *UpgradeStrategy) error {
+	var err error
+	if strategy.rollback() {
+		r.log.Warnf("Rolling back stack: %s", stack.Name)
+		stack, err = prjClient.Environment.ActionRollback(stack)
+	} else {
+		r.log.Warnf("Cancelling upgrade of stack: %s", stack.Name)
+		stack, err = prjClient.Environment.ActionCancelupgrade(stack)
+	}
+	if err != nil {
+		return err
+	}
+	return waitForStack(prjClient, stack)
+}
+
+// upgradeService rolls a new image out to a service in batches, finishing
+// the upgrade once the service is healthy.
+func (r *RancherServer) upgradeService(prjClient *client.RancherClient, stack *client.Environment, service *client.Service, image string, strategy *UpgradeStrategy) error {
+	timeout, err := strategy.timeout()
+	if err != nil {
+		return err
+	}
+
+	launchConfig := *service.LaunchConfig
+	launchConfig.ImageUuid = "docker:" + image
+
+	inServiceStrategy := &client.InServiceUpgradeStrategy{
+		LaunchConfig: &launchConfig,
+	}
+	if strategy != nil {
+		inServiceStrategy.BatchSize = strategy.BatchSize
+		inServiceStrategy.IntervalMillis = strategy.IntervalMillis
+		inServiceStrategy.StartFirst = strategy.StartFirst
+	}
+
+	r.log.Infof("Upgrading service %s/%s to: %s", stack.Name, service.Name, image)
+	service, err = prjClient.Service.ActionUpgrade(service, &client.ServiceUpgrade{
+		InServiceStrategy: inServiceStrategy,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = waitForService(prjClient, service); err == nil && service.State != "upgraded" {
+		err = fmt.Errorf("Upgrade of service %s/%s ended in state %s: %s", stack.Name, service.Name, service.State, service.TransitioningMessage)
+	}
+	if err == nil {
+		err = r.waitForServicesHealthy(prjClient, stack, []string{service.Name}, timeout)
+	}
+	if err != nil {
+		if revertErr := r.revertServiceUpgrade(prjClient, service, strategy); revertErr != nil {
+			r.log.Errorf("Could not revert upgrade of service %s/%s: %s", stack.Name, service.Name, revertErr)
+		}
+		return err
+	}
+
+	r.log.Infof("Finishing upgrade of service: %s/%s", stack.Name, service.Name)
+	service, err = prjClient.Service.ActionFinishupgrade(service)
+	if err != nil {
+		return err
+	}
+	return waitForService(prjClient, service)
+}
+
+func (r *RancherServer) revertServiceUpgrade(prjClient *client.RancherClient, service *client.Service, strategy *UpgradeStrategy) error {
+	var err error
+	if strategy.rollback() {
+		r.log.Warnf("Rolling back service: %s", service.Name)
+		service, err = prjClient.Service.ActionRollback(service)
+	} else {
+		r.log.Warnf("Cancelling upgrade of service: %s", service.Name)
+		service, err = prjClient.Service.ActionCancelupgrade(service)
+	}
+	if err != nil {
+		return err
+	}
+	return waitForService(prjClient, service)
+}
+
+// waitForStack waits for a stack to settle, failing when it settled in error.
+func waitForStack(prjClient *client.RancherClient, stack *client.Environment) error {
+	err := WaitFor(prjClient, &stack.Resource, stack, func() string {
+		return stack.Transitioning
+	})
+	if err == nil && stack.Transitioning == "error" {
+		err = fmt.Errorf("Stack %s failed: %s", stack.Name, stack.TransitioningMessage)
+	}
+	return err
+}
+
+// waitForService waits for a service to settle, failing when it settled in
+// error.
+func waitForService(prjClient *client.RancherClient, service *client.Service) error {
+	err := WaitFor(prjClient, &service.Resource, service, func() string {
+		return service.Transitioning
+	})
+	if err == nil && service.Transitioning == "error" {
+		err = fmt.Errorf("Service %s failed: %s", service.Name, service.TransitioningMessage)
+	}
+	return err
+}
+
+// waitForServicesHealthy polls the services of a stack until all of them, or
+// the named ones, are active and healthy, or the timeout passes.
+func (r *RancherServer) waitForServicesHealthy(prjClient *client.RancherClient, stack *client.Environment, names []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		services, err := getStackServices(prjClient, stack)
+		if err != nil {
+			return err
+		}
+
+		unhealthy := []string{}
+		for _, service := range services {
+			if names != nil && !contains(names, service.Name) {
+				continue
+			}
+			if !serviceHealthy(service) {
+				unhealthy = append(unhealthy, service.Name)
+			}
+		}
+		if len(unhealthy) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Services of stack %s did not become healthy within %s: %s", stack.Name, timeout, strings.Join(unhealthy, ", "))
+		}
+		r.log.Debugf("Waiting for services of stack %s: %v", stack.Name, unhealthy)
+		time.Sleep(stackHealthPollInterval)
+	}
+}
+
+func serviceHealthy(service stackService) bool {
+	if service.State != "active" && service.State != "upgraded" {
+		return false
+	}
+	return service.HealthState == "" || service.HealthState == "healthy"
+}
+
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+const webCompose = "web:\n  image: nginx:1.10\n"
+
+func stackConfig() *RancherBootstrapConfig {
+	return &RancherBootstrapConfig{
+		Projects: map[string]*Project{
+			"dev": {Project: client.Project{Name: "dev"}},
+		},
+		Stacks: map[string]map[string]*Stack{
+			"dev": {
+				"web": {
+					DockerCompose: webCompose,
+					Environment:   map[string]string{"PORT": "80"},
+				},
+			},
+		},
+	}
+}
+
+func (s *testServer) stacks() []client.Environment {
+	stacks := []client.Environment{}
+	s.fake.List("environment", &stacks)
+	return stacks
+}
+
+// addService adds a service with healthState to the only stack.
+func (s *testServer) addService(name string, image string, healthState string) {
+	stack := s.stacks()[0]
+	s.fake.Add("service", map[string]interface{}{
+		"name":          name,
+		"accountId":     stack.AccountId,
+		"environmentId": stack.Id,
+		"healthState":   healthState,
+		"launchConfig":  map[string]interface{}{"imageUuid": "docker:" + image},
+	})
+}
+
+// actions returns the actions requested since the request numbered since.
+func (s *testServer) actions(since int) []string {
+	actions := []string{}
+	for _, request := range s.fake.Requests()[since:] {
+		if i := strings.Index(request, "?action="); i >= 0 {
+			actions = append(actions, request[i+len("?action="):])
+		}
+	}
+	return actions
+}
+
+func TestApplyCreatesStacks(t *testing.T) {
+	s := newTestServer(t, stackConfig())
+	defer s.Close()
+
+	if status := s.apply(t); status.DriftCount != 2 || status.Changes[1].Kind != "stack" || status.Changes[1].Action != "create" {
+		t.Fatalf("Expected the stack created, got %v", status.Changes)
+	}
+	stacks := s.stacks()
+	if len(stacks) != 1 || stacks[0].DockerCompose != webCompose || stacks[0].Environment["PORT"] != "80" {
+		t.Fatalf("Unexpected stacks: %#v", stacks)
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+
+	// Saved on another system, the same compose file does not upgrade.
+	s.config.Stacks["dev"]["web"].DockerCompose = strings.Replace(webCompose, "\n", "\r\n", -1) + "\n"
+	before := len(s.fake.Requests())
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Line endings changed %v", status.Changes)
+	}
+	if actions := s.actions(before); len(actions) != 0 {
+		t.Fatalf("Unexpected actions: %v", actions)
+	}
+}
+
+func TestApplyUpgradesStacks(t *testing.T) {
+	s := newTestServer(t, stackConfig())
+	defer s.Close()
+	s.apply(t)
+	s.addService("web", "nginx:1.10", "healthy")
+
+	s.config.Stacks["dev"]["web"].DockerCompose = "web:\n  image: nginx:1.11\n"
+	before := len(s.fake.Requests())
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Action != "update" {
+		t.Fatalf("Expected the stack upgraded, got %v", status.Changes)
+	}
+	if actions := strings.Join(s.actions(before), ", "); actions != "upgrade, finishupgrade" {
+		t.Fatalf("Expected the upgrade finished, got %s", actions)
+	}
+	if stack := s.stacks()[0]; stack.State != "active" || stack.DockerCompose != "web:\n  image: nginx:1.11\n" {
+		t.Fatalf("Unexpected stack: %#v", stack)
+	}
+}
+
+func TestApplyRevertsUnhealthyStacks(t *testing.T) {
+	for _, test := range []struct {
+		onFailure string
+		action    string
+		state     string
+		compose   string
+	}{
+		{"", "rollback", "active", webCompose},
+		{"cancel", "cancelupgrade", "canceled-upgrade", "web:\n  image: nginx:1.11\n"},
+	} {
+		s := newTestServer(t, stackConfig())
+		s.apply(t)
+		s.addService("web", "nginx:1.10", "unhealthy")
+
+		stack := s.config.Stacks["dev"]["web"]
+		stack.DockerCompose = "web:\n  image: nginx:1.11\n"
+		stack.Upgrade = &UpgradeStrategy{Timeout: "50ms", OnFailure: test.onFailure}
+		before := len(s.fake.Requests())
+		status := s.ApplyOnce()
+		if status.Success || !strings.Contains(status.Error, "did not become healthy within 50ms: web") {
+			t.Errorf("Expected the upgrade to time out, got %s", status.Error)
+		}
+		if actions := strings.Join(s.actions(before), ", "); actions != "upgrade, "+test.action {
+			t.Errorf("Expected upgrade, %s, got %s", test.action, actions)
+		}
+		if stack := s.stacks()[0]; stack.State != test.state || stack.DockerCompose != test.compose {
+			t.Errorf("Unexpected stack after %s: %#v", test.action, stack)
+		}
+		s.Close()
+	}
+}
+
+func TestApplyUpgradesServices(t *testing.T) {
+	s := newTestServer(t, stackConfig())
+	defer s.Close()
+	s.apply(t)
+	s.addService("web", "nginx:1.10", "healthy")
+
+	s.config.Stacks["dev"]["web"].Services = map[string]*StackService{"web": {Image: "nginx:1.11"}}
+
+	if status := s.apply(t); status.DriftCount != 1 || status.Changes[0].Kind != "service" {
+		t.Fatalf("Expected the service upgraded, got %v", status.Changes)
+	}
+	services := []client.Service{}
+	s.fake.List("service", &services)
+	if services[0].State != "active" || services[0].LaunchConfig.ImageUuid != "docker:nginx:1.11" {
+		t.Fatalf("Unexpected service: %#v", services[0])
+	}
+
+	if status := s.apply(t); status.DriftCount != 0 {
+		t.Fatalf("Second run changed %v", status.Changes)
+	}
+}
+
+func TestApplyFailsOnStacksInError(t *testing.T) {
+	s := newTestServer(t, stackConfig())
+	defer s.Close()
+
+	s.fake.Transition("environment", "error")
+	if status := s.ApplyOnce(); status.Success || !strings.Contains(status.Error, "Stack web failed") {
+		t.Fatalf("Expected the stack to fail, got %#v", status)
+	}
+}
@@ -0,0 +1,266 @@
+package rancher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/rancher/go-rancher/client"
+)
+
+// stateData is what the state file holds: the Rancher ID of each project and
+// account, by its key in the config.
+type stateData struct {
+	Projects map[string]string `yaml:"projects"`
+	Accounts map[string]string `yaml:"accounts"`
+}
+
+// state ties config keys to the resources rbs created or adopted for them,
+// so they are still found after their name changed. A nil state tracks
+// nothing and everything is matched by name, one without a path is only
+// kept in memory.
+type state struct {
+	sync.Mutex
+	path string
+	data stateData
+}
+
+func loadState(path string) (*state, error) {
+	s := newMemoryState()
+	s.path = path
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := candiedyaml.NewDecoder(file)
+	if err = decoder.Decode(&s.data); err != nil {
+		return nil, fmt.Errorf("Could not parse state file: %s\n%s", path, err)
+	}
+	if s.data.Projects == nil {
+		s.data.Projects = map[string]string{}
+	}
+	if s.data.Accounts == nil {
+		s.data.Accounts = map[string]string{}
+	}
+
+	return s, nil
+}
+
+func newMemoryState() *state {
+	return &state{
+		data: stateData{
+			Projects: map[string]string{},
+			Accounts: map[string]string{},
+		},
+	}
+}
+
+func (s *state) ids(kind string) map[string]string {
+	if kind == "project" {
+		return s.data.Projects
+	}
+	return s.data.Accounts
+}
+
+// get returns the ID recorded for the config key of a project or account.
+func (s *state) get(kind string, key string) string {
+	if s == nil {
+		return ""
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	return s.ids(kind)[key]
+}
+
+// key returns the config key id is recorded for.
+func (s *state) key(kind string, id string) string {
+	if s == nil {
+		return ""
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	for key, recorded := range s.ids(kind) {
+		if recorded == id {
+			return key
+		}
+	}
+	return ""
+}
+
+// set records id for key and writes the state file when it changed.
+func (s *state) set(kind string, key string, id string) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ids(kind)[key] == id {
+		return nil
+	}
+	s.ids(kind)[key] = id
+	return s.write()
+}
+
+func (s *state) remove(kind string, key string) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.ids(kind)[key]; !ok {
+		return nil
+	}
+	delete(s.ids(kind), key)
+	return s.write()
+}
+
+// write replaces the state file by renaming a new one over it, so a crash
+// while writing leaves the old state instead of a truncated one.
+func (s *state) write() error {
+	if s.path == "" {
+		return nil
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(s.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	fileToWrite, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return fmt.Errorf("Could not write state file: %s\n%s", s.path, err)
+	}
+	defer os.Remove(fileToWrite.Name())
+
+	err = candiedyaml.NewEncoder(fileToWrite).Encode(s.data)
+	if closeErr := fileToWrite.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fileToWrite.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(fileToWrite.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write state file: %s\n%s", s.path, err)
+	}
+	return nil
+}
+
+// SetStateFile keeps the IDs of the projects and accounts rbs manages in
+// path, so renaming them in the config renames them on the server instead
+// of creating new ones.
+func (r *RancherServer) SetStateFile(path string) error {
+	s, err := loadState(path)
+	if err != nil {
+		return err
+	}
+	r.state = s
+	return nil
+}
+
+// getStateProject returns the project recorded for key, or nil if there is
+// none or it is gone.
+func (r *RancherServer) getStateProject(key string) (*client.Project, error) {
+	id := r.state.get("project", key)
+	if id == "" {
+		return nil, nil
+	}
+
+	project, err := r.client.Project.ById(id)
+	if err != nil {
+		return nil, err
+	}
+	if project == nil || project.State == "removed" || project.State == "purged" {
+		r.log.Warnf("Project %s in the state file is gone: %s", key, id)
+		return nil, r.state.remove("project", key)
+	}
+	return project, nil
+}
+
+// findProject returns the project for config key, the one recorded in the
+// state file or else the one named like prj.
+func (r *RancherServer) findProject(key string, prj *Project) (*client.Project, error) {
+	project, err := r.getStateProject(key)
+	if err != nil || project != nil {
+		return project, err
+	}
+
+	project, err = r.getProjectByName(prj.Name)
+	if err != nil || project.Id == "" {
+		return nil, err
+	}
+	return project, nil
+}
+
+// ImportState adopts the existing projects and accounts of the config into
+// the state file, matching them by name like a run without state does.
+func (r *RancherServer) ImportState() error {
+	if r.state == nil {
+		return fmt.Errorf("No state file to import into")
+	}
+
+	keys := []string{}
+	for key := range r.config.Projects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		project, err := r.findProject(key, r.config.Projects[key])
+		if err != nil {
+			return err
+		}
+		if project == nil {
+			r.log.Infof("Project %s does not exist, not importing it", key)
+			continue
+		}
+		r.log.Infof("Importing project %s: %s", key, project.Id)
+		if err := r.state.set("project", key, project.Id); err != nil {
+			return err
+		}
+	}
+
+	accounts, err := r.inventory.Accounts()
+	if err != nil {
+		return err
+	}
+
+	keys = []string{}
+	for key := range r.config.Accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		account, _, err := r.findAccount(accounts, key, r.config.Accounts[key])
+		if err != nil {
+			return err
+		}
+		if account == nil {
+			r.log.Infof("Account %s does not exist, not importing it", key)
+			continue
+		}
+		r.log.Infof("Importing account %s: %s", key, account.Id)
+		if err := r.state.set("account", key, account.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.yml")
+	writeFile(t, path, "projects:\n  dev: 1a5\n")
+
+	s, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("project", "qa", "1a7"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.get("project", "dev") != "1a5" || loaded.get("project", "qa") != "1a7" {
+		t.Fatalf("Unexpected state: %#v", loaded.data)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the mode of the old file, got %v", info.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected only the state file, got %d files", len(files))
+	}
+}
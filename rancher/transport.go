@@ -0,0 +1,39 @@
+package rancher
+
+import (
+	"net/http"
+	"sync"
+)
+
+var contentLengthOnce sync.Once
+
+// dropContentLengthHeader works around the vendored client, which sets the
+// Content-Length header of creates and updates to string(len(body)), a
+// single character rather than the number. net/http sends the length of the
+// body whatever the header says, but newer versions reject the request when
+// the character is not valid in a header, as it is for bodies shorter than
+// 32 bytes. All requests of the client go through the default transport.
+func dropContentLengthHeader() {
+	contentLengthOnce.Do(func() {
+		http.DefaultTransport = &contentLengthTransport{next: http.DefaultTransport}
+	})
+}
+
+type contentLengthTransport struct {
+	next http.RoundTripper
+}
+
+func (t *contentLengthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Header["Content-Length"]; ok {
+		// Round trippers must not change the request they are given.
+		copied := *req
+		copied.Header = http.Header{}
+		for key, values := range req.Header {
+			if key != "Content-Length" {
+				copied.Header[key] = values
+			}
+		}
+		req = &copied
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,221 @@
+package rancher
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+// ConfigureVolumes creates and removes the named volumes declared per
+// project. Volumes can not be changed in place, so differing driver options
+// on an existing volume are only reported.
+func (r *RancherServer) ConfigureVolumes() error {
+	for projectName, configVolumes := range r.config.Volumes {
+		if err := r.configureProjectVolumes(projectName, configVolumes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RancherServer) configureProjectVolumes(projectName string, configVolumes []*client.Volume) error {
+	r.log.Infof("Configuring volumes for project: %s", projectName)
+	project, err := r.getProjectByName(projectName)
+	if err != nil {
+		return err
+	}
+	if project.Id == "" {
+		return fmt.Errorf("Project %s does not exist", projectName)
+	}
+
+	projectClient, err := r.projectClients.Get(project, r.log)
+	if err != nil {
+		return err
+	}
+
+	existingVolumes, err := projectClient.Volume.List(&client.ListOpts{})
+	if err == nil {
+		err = followPages(projectClient, existingVolumes)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range configVolumes {
+		if !r.selected("volume", volume.Name) {
+			continue
+		}
+
+		existing := getExistingVolume(existingVolumes, volume)
+
+		if volume.State == "Purged" {
+			if existing != nil {
+				r.log.Infof("Removing volume: %s", volume.Name)
+				if err := projectClient.Volume.Delete(existing); err != nil {
+					return err
+				}
+				r.recordChange(projectName, "volume", "delete", volume.Name)
+			}
+			continue
+		}
+
+		if existing != nil {
+			if !reflect.DeepEqual(existing.DriverOpts, volume.DriverOpts) && len(volume.DriverOpts) > 0 {
+				r.log.Warnf("Volume %s exists with different driver options, volumes can not be changed in place", volume.Name)
+			}
+			continue
+		}
+
+		if err := checkStoragePool(projectClient, volume.Driver); err != nil {
+			return err
+		}
+
+		r.log.Infof("Adding volume: %s", volume.Name)
+		created, err := projectClient.Volume.Create(&client.Volume{
+			Name:        volume.Name,
+			Description: volume.Description,
+			Driver:      volume.Driver,
+			DriverOpts:  volume.DriverOpts,
+		})
+		if err != nil {
+			return err
+		}
+		if err := WaitFor(projectClient, &created.Resource, created, func() string {
+			return created.Transitioning
+		}); err != nil {
+			return err
+		}
+		r.recordChange(projectName, "volume", "create", volume.Name)
+	}
+
+	return nil
+}
+
+// SnapshotVolumes snapshots every volume in the configured projects whose
+// name matches one of the glob patterns.
+func (r *RancherServer) SnapshotVolumes(patterns []string) error {
+	projectNames := []string{}
+	for _, project := range r.config.Projects {
+		if project.State != "Purged" {
+			projectNames = append(projectNames, project.Name)
+		}
+	}
+	sort.Strings(projectNames)
+
+	suffix := time.Now().UTC().Format("20060102-150405")
+	for _, projectName := range projectNames {
+		project, err := r.getProjectByName(projectName)
+		if err != nil {
+			return err
+		}
+		if project.Id == "" {
+			continue
+		}
+
+		projectClient, err := r.projectClients.Get(project, r.log)
+		if err != nil {
+			return err
+		}
+
+		volumes, err := projectClient.Volume.List(&client.ListOpts{})
+		if err == nil {
+			err = followPages(projectClient, volumes)
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, volume := range volumes.Data {
+			if volume.Name == "" || volume.State == "removed" || volume.State == "purged" {
+				continue
+			}
+
+			matched, err := matchesAny(patterns, volume.Name)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+
+			r.log.Infof("Snapshotting volume %s in project: %s", volume.Name, projectName)
+			if err := snapshotVolume(projectClient, &volumes.Data[i], volume.Name+"-"+suffix); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func snapshotVolume(prjClient *client.RancherClient, volume *client.Volume, name string) error {
+	snapshot := &client.Snapshot{}
+	var err error
+
+	// Newer servers expose snapshots as a volume action.
+	if actionURL, ok := volume.Actions["snapshot"]; ok {
+		err = prjClient.Post(actionURL, &client.Snapshot{Name: name}, snapshot)
+	} else {
+		snapshot, err = prjClient.Snapshot.Create(&client.Snapshot{
+			Name:     name,
+			VolumeId: volume.Id,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WaitFor(prjClient, &snapshot.Resource, snapshot, func() string {
+		return snapshot.Transitioning
+	})
+}
+
+// checkStoragePool makes sure a project has an active storage pool for a
+// volume driver before volumes are created with it.
+func checkStoragePool(prjClient *client.RancherClient, driver string) error {
+	if driver == "" || driver == "local" {
+		return nil
+	}
+
+	pools, err := prjClient.StoragePool.List(&client.ListOpts{})
+	if err == nil {
+		err = followPages(prjClient, pools)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range pools.Data {
+		if pool.DriverName == driver && pool.State == "active" {
+			return nil
+		}
+	}
+	return fmt.Errorf("No active storage pool for volume driver: %s", driver)
+}
+
+func getExistingVolume(collection *client.VolumeCollection, volume *client.Volume) *client.Volume {
+	for i, vol := range collection.Data {
+		if vol.Name == volume.Name && vol.State != "removed" && vol.State != "purged" {
+			return &collection.Data[i]
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("Invalid pattern: %s", pattern)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -1,20 +1,36 @@
 package rancher
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/rancher/go-rancher/client"
 )
 
-// WaitFor waits for a resource to reach a certain state.
+var (
+	// waitTimeout is how long WaitFor waits for a resource, so that one
+	// stuck in a transition fails the run instead of hanging it.
+	waitTimeout = 10 * time.Minute
+
+	waitPollInterval = 150 * time.Millisecond
+)
+
+// WaitFor waits for a resource to reach a certain state. It returns once the
+// resource stops transitioning, which includes ending up in error: callers
+// check the state it ended in. It fails when that takes longer than
+// waitTimeout.
 func WaitFor(c *client.RancherClient, resource *client.Resource, output interface{}, transitioning func() string) error {
+	deadline := time.Now().Add(waitTimeout)
 	for {
 		transitioning := transitioning()
-		if transitioning != "yes" && transitioning == "no" {
+		if transitioning == "no" || transitioning == "error" {
 			return nil
 		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The %s %s is still transitioning after %s", resource.Type, resource.Id, waitTimeout)
+		}
 
-		time.Sleep(150 * time.Millisecond)
+		time.Sleep(waitPollInterval)
 
 		err := c.Reload(resource, output)
 		if err != nil {
@@ -0,0 +1,42 @@
+package rancher
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+)
+
+func TestWaitFor(t *testing.T) {
+	defer func(timeout time.Duration) { waitTimeout = timeout }(waitTimeout)
+	waitTimeout = 50 * time.Millisecond
+
+	s := newTestServer(t, &RancherBootstrapConfig{})
+	defer s.Close()
+	id := s.fake.Add("account", &client.Account{Name: "waited"})
+
+	for _, test := range []struct {
+		transitioning string
+		err           string
+	}{
+		{"no", ""},
+		// Resources ending up in error stop the wait, the caller checks
+		// what state they are in.
+		{"error", ""},
+		{"yes", "still transitioning after 50ms"},
+	} {
+		s.fake.Transition("account", test.transitioning)
+		account, err := s.client.Account.ById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = WaitFor(s.client, &account.Resource, account, func() string {
+			return account.Transitioning
+		})
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("Expected %q waiting for a %s account, got %v", test.err, test.transitioning, err)
+		}
+	}
+}